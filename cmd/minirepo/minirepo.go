@@ -17,12 +17,16 @@
 package main
 
 import (
+	"errors"
 	"flag"
+	"fmt"
 	"github.com/mitchellh/go-homedir"
 	log "github.com/sirupsen/logrus"
-	minirepo2 "github.com/uubk/minirepo/internal/minirepo"
+	"github.com/uubk/minirepo/pkg/minirepo/server"
+	"golang.org/x/crypto/ssh/terminal"
 	"os"
 	"path"
+	"runtime"
 )
 
 func main() {
@@ -30,9 +34,40 @@ func main() {
 	root := flag.String("root", "~/.minirepo", "Minirepo root directory")
 	repo := flag.String("repo", "~/.minirepo/repo", "Minirepo repository directory")
 	name := flag.String("Name", "minirepo", "Minirepo repository Name")
+	rehash := flag.Bool("rehash", false, "Ignore the hash cache and hash all files again")
+	jobs := flag.Int("jobs", runtime.NumCPU(), "Number of files to hash concurrently")
+	validity := flag.Duration("validity", 0, "Time after which clients consider the metadata stale (0 to disable)")
+	passphraseEnv := flag.String("passphrase-env", "", "Environment variable containing the private key passphrase")
+	passphraseFile := flag.String("passphrase-file", "", "File containing the private key passphrase")
+	passphrasePrompt := flag.Bool("passphrase-prompt", false, "Prompt for the private key passphrase")
+	keyType := flag.String("key-type", string(server.DefaultKeyAlgorithm),
+		fmt.Sprintf("Algorithm of newly generated keys (one of %v)", server.KeyAlgorithms))
 
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [rotate-key [-finish] | sign]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
+	// Without a command, the metadata is just updated
+	rotateKey := false
+	finishRotation := false
+	sign := false
+	switch flag.Arg(0) {
+	case "":
+	case "sign":
+		sign = true
+	case "rotate-key":
+		rotateFlags := flag.NewFlagSet("rotate-key", flag.ExitOnError)
+		finish := rotateFlags.Bool("finish", false, "Replace the current key with the one generated by rotate-key")
+		rotateFlags.Parse(flag.Args()[1:])
+		rotateKey = true
+		finishRotation = *finish
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+
 	if *verbose {
 		log.SetLevel(log.DebugLevel)
 	}
@@ -48,17 +83,96 @@ func main() {
 
 	os.Mkdir(rootDir, 0700)
 
-	svc := minirepo2.NewServer(rootDir, repoDir, *name)
+	svc := server.NewServer(rootDir, repoDir, *name)
+	svc.SetForceRehash(*rehash)
+	svc.SetJobs(*jobs)
+	svc.SetValidity(*validity)
+	keyAlgorithm, err := server.ParseKeyAlgorithm(*keyType)
+	if err != nil {
+		log.WithError(err).Fatal("Invalid key type")
+	}
+	svc.SetKeyAlgorithm(keyAlgorithm)
 
 	// Ensure public/private keys exists
 	pubkeyFile := path.Join(rootDir, "pub.asc")
 	_, err = os.Stat(pubkeyFile)
+	if err != nil && sign {
+		// Signing with a freshly generated key is pointless, as no client trusts it
+		log.WithError(err).WithField("root", rootDir).Fatal("Couldn't find keys to sign with")
+	}
+	generate := err != nil || (rotateKey && !finishRotation)
+	switch {
+	case *passphraseEnv != "":
+		svc.SetPassphrase(server.PassphraseFromEnv(*passphraseEnv))
+	case *passphraseFile != "":
+		svc.SetPassphrase(server.PassphraseFromFile(*passphraseFile))
+	case *passphrasePrompt:
+		svc.SetPassphrase(promptPassphrase(generate))
+	}
 	if err != nil {
 		// File does not exist -> generate new keys
-		svc.GenerateKeypair()
+		err = svc.GenerateKeypair()
+		if err != nil {
+			log.WithError(err).Fatal("Couldn't generate keys")
+		}
 	}
 	log.Info("Loading keys")
-	svc.LoadKeypair()
+	err = svc.LoadKeypair()
+	if err != nil {
+		log.WithError(err).Fatal("Couldn't load keys")
+	}
+	if rotateKey {
+		if finishRotation {
+			log.Info("Finishing key rotation")
+			err = svc.FinishKeyRotation()
+		} else {
+			log.Info("Starting key rotation")
+			err = svc.StartKeyRotation()
+		}
+		if err != nil {
+			log.WithError(err).Fatal("Couldn't rotate key")
+		}
+	}
+	if sign {
+		log.Info("Adding signature to existing metadata")
+		err = svc.AddSignature()
+		if err != nil {
+			log.WithError(err).Fatal("Couldn't sign metadata")
+		}
+		return
+	}
 	log.Info("Updating metadata")
-	svc.UpdateMetadata()
+	stats, err := svc.UpdateMetadata()
+	if err != nil {
+		log.WithError(err).Fatal("Couldn't update metadata")
+	}
+	log.WithFields(log.Fields{
+		"hashed": stats.Hashed,
+		"reused": stats.Reused,
+	}).Info("Metadata updated")
+}
+
+// promptPassphrase returns a PassphraseFunc asking for the passphrase on the terminal. If 'confirm' is set, e.g. because
+// a new key is encrypted with it, the passphrase has to be entered twice.
+func promptPassphrase(confirm bool) server.PassphraseFunc {
+	return func() ([]byte, error) {
+		fmt.Fprint(os.Stderr, "Private key passphrase: ")
+		passphrase, err := terminal.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return nil, err
+		}
+		if confirm {
+			fmt.Fprint(os.Stderr, "Repeat passphrase: ")
+			repeated, err := terminal.ReadPassword(int(os.Stdin.Fd()))
+			fmt.Fprintln(os.Stderr)
+			if err != nil {
+				return nil, err
+			}
+			if string(repeated) != string(passphrase) {
+				return nil, errors.New("passphrases don't match")
+			}
+		}
+		return passphrase, nil
+	}
 }
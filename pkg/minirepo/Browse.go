@@ -0,0 +1,197 @@
+/*
+ * Copyright 2018 The minirepo authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minirepo
+
+import (
+	"context"
+	"fmt"
+	"github.com/uubk/minirepo/pkg/minirepo/types"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// FileInfo describes a file or directory contained in the repository
+type FileInfo struct {
+	// Path inside the repository, one element per segment
+	Path []string
+	// SHA-256 hash in Hex encoding, empty for directories
+	Hash string
+	// Size in bytes, 0 for directories or if the metadata doesn't contain it
+	Size int64
+}
+
+// Name returns the last segment of the path
+func (f FileInfo) Name() string {
+	return f.Path[len(f.Path)-1]
+}
+
+// IsDir returns whether this is a directory
+func (f FileInfo) IsDir() bool {
+	return f.Hash == ""
+}
+
+// newFileInfo describes 'entry', which is contained in the directory 'parent'
+func newFileInfo(parent []string, entry *types.DirEntry) FileInfo {
+	filePath := make([]string, len(parent), len(parent)+1)
+	copy(filePath, parent)
+	info := FileInfo{
+		Path: append(filePath, entry.Name),
+		Hash: entry.Hash,
+	}
+	if entry.Size != nil {
+		info.Size = *entry.Size
+	}
+	return info
+}
+
+// List returns the contents of the directory 'dirPath'. Without a path, the root of the repository is listed.
+func (m *Minirepo) List(dirPath ...string) ([]FileInfo, error) {
+	meta := m.currentMeta()
+	if meta == nil {
+		return nil, ErrNoMetadata
+	}
+	children := meta.Contents
+	if len(dirPath) > 0 {
+		entry, err := findFile(meta, dirPath...)
+		if err != nil {
+			return nil, err
+		}
+		if entry.Hash != "" {
+			return nil, ErrNotDirectory
+		}
+		children = entry.Children
+	}
+
+	result := make([]FileInfo, 0, len(children))
+	for i := range children {
+		result = append(result, newFileInfo(dirPath, &children[i]))
+	}
+	return result, nil
+}
+
+// Walk calls 'walkFn' for every file and directory in the repository. Directories are visited before their contents.
+// If 'walkFn' returns filepath.SkipDir, the contents of the directory are skipped (for files, this is the same as
+// returning nil). Any other error stops the walk and is returned.
+func (m *Minirepo) Walk(walkFn func(info FileInfo) error) error {
+	meta := m.currentMeta()
+	if meta == nil {
+		return ErrNoMetadata
+	}
+	return walkEntries(nil, meta.Contents, walkFn)
+}
+
+// walkEntries calls 'walkFn' for 'entries' contained in the directory 'parent' and their children
+func walkEntries(parent []string, entries []types.DirEntry, walkFn func(info FileInfo) error) error {
+	for i := range entries {
+		info := newFileInfo(parent, &entries[i])
+		err := walkFn(info)
+		if err == filepath.SkipDir {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			err = walkEntries(info.Path, entries[i].Children, walkFn)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Glob returns all files and directories whose path matches 'pattern'. The pattern consists of segments separated by
+// '/', each segment is matched against one path segment using the syntax of path.Match. For example, 'linux/*/latest/*'
+// matches all files in the 'latest' directories of all components for Linux.
+func (m *Minirepo) Glob(pattern string) ([]FileInfo, error) {
+	meta := m.currentMeta()
+	if meta == nil {
+		return nil, ErrNoMetadata
+	}
+	segments := strings.Split(pattern, "/")
+	// Check the pattern up front, path.Match only reports errors when it gets to the broken part
+	for _, segment := range segments {
+		_, err := path.Match(segment, "")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var result []FileInfo
+	err := walkEntries(nil, meta.Contents, func(info FileInfo) error {
+		depth := len(info.Path)
+		matched, _ := path.Match(segments[depth-1], info.Name())
+		if !matched {
+			return filepath.SkipDir
+		}
+		if depth == len(segments) {
+			result = append(result, info)
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	return result, err
+}
+
+// LatestVersion returns the highest version of 'component' for 'platform' that satisfies 'constraint' (see
+// ParseConstraint), assuming the repository is laid out as 'platform/component/version/file'. Directories whose name
+// isn't a semantic version are ignored.
+func (m *Minirepo) LatestVersion(platform, component, constraint string) (*Version, error) {
+	parsedConstraint, err := ParseConstraint(constraint)
+	if err != nil {
+		return nil, err
+	}
+	versions, err := m.List(platform, component)
+	if err != nil {
+		return nil, err
+	}
+
+	var latest *Version
+	for _, item := range versions {
+		if !item.IsDir() {
+			continue
+		}
+		version, err := ParseVersion(item.Name())
+		if err != nil || !parsedConstraint.Check(version) {
+			continue
+		}
+		if latest == nil || version.Compare(latest) > 0 {
+			latest = version
+		}
+	}
+	if latest == nil {
+		return nil, fmt.Errorf("%w: %s/%s %s", ErrNoMatchingVersion, platform, component, constraint)
+	}
+	return latest, nil
+}
+
+// GetLatest returns a local path to 'file' of the highest version of 'component' for 'platform' that satisfies
+// 'constraint', see LatestVersion
+func (m *Minirepo) GetLatest(platform, component, constraint, file string) (string, error) {
+	return m.GetLatestContext(context.Background(), platform, component, constraint, file)
+}
+
+// GetLatestContext is like GetLatest, but aborts the download when 'ctx' is done
+func (m *Minirepo) GetLatestContext(ctx context.Context, platform, component, constraint, file string) (string, error) {
+	version, err := m.LatestVersion(platform, component, constraint)
+	if err != nil {
+		return "", err
+	}
+	return m.GetFileContext(ctx, platform, component, version.String(), file)
+}
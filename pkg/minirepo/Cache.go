@@ -0,0 +1,290 @@
+/*
+ * Copyright 2018 The minirepo authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minirepo
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/uubk/minirepo/pkg/minirepo/types"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// internalFiles contains the files in the root of the cache directory that don't belong to the repository
+var internalFiles = map[string]bool{
+	"meta.yml":              true,
+	"meta.yml.tmp":          true,
+	"meta.asc":              true,
+	"meta.asc.tmp":          true,
+	"state.yml":             true,
+	"state.yml.tmp":         true,
+	keyHistoryName:          true,
+	keyHistoryName + ".tmp": true,
+	lockFileName:            true,
+}
+
+// Subdirectories of types.ReservedDir containing the lock files and partial downloads of cached files
+const (
+	locksDir   = "locks"
+	partialDir = "partial"
+)
+
+// cacheFileID returns the name of the internal files of the cached file 'fileKey'. Paths are hashed, so the names
+// never collide and always fit into a single path segment.
+func cacheFileID(fileKey string) string {
+	sum := sha256.Sum256([]byte(fileKey))
+	return hex.EncodeToString(sum[:])
+}
+
+// internalFile returns the path of the internal file 'id' (see cacheFileID) in the subdirectory 'kind' of the reserved
+// directory, creating the subdirectory if necessary
+func (m *Minirepo) internalFile(kind, id string) (string, error) {
+	dir := path.Join(m.localCache, types.ReservedDir, kind)
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return "", err
+	}
+	return path.Join(dir, id), nil
+}
+
+// GC removes all files from the local cache that are not part of the current metadata anymore, including directories
+// that end up empty. Files are locked before they are removed, so downloads in progress are never disturbed.
+func (m *Minirepo) GC() error {
+	meta := m.currentMeta()
+	if meta == nil {
+		return ErrNoMetadata
+	}
+
+	var dirs []string
+	err := filepath.Walk(m.localCache, func(file string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			// Removed together with the file it belongs to
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		relFile, err := filepath.Rel(m.localCache, file)
+		if err != nil {
+			return err
+		}
+		fileKey := filepath.ToSlash(relFile)
+		if info.IsDir() {
+			if fileKey == types.ReservedDir {
+				return filepath.SkipDir
+			}
+			if fileKey != "." {
+				dirs = append(dirs, file)
+			}
+			return nil
+		}
+		if internalFiles[fileKey] || isListed(meta, fileKey) {
+			return nil
+		}
+		return m.removeCachedFile(fileKey)
+	})
+	if err != nil {
+		return err
+	}
+
+	// Walk visits parents before their children, so remove directories in reverse order. Removing directories that
+	// are not empty fails, which is fine.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		os.Remove(dirs[i])
+	}
+	err = m.removeOrphans(meta)
+	if err != nil {
+		return err
+	}
+	return m.updateState(func(state *clientState) error {
+		for fileKey := range state.Files {
+			_, err := os.Stat(path.Join(m.localCache, fileKey))
+			if os.IsNotExist(err) {
+				delete(state.Files, fileKey)
+			}
+		}
+		return nil
+	})
+}
+
+// isListed checks whether 'fileKey' is a file contained in 'meta'
+func isListed(meta *types.RepoInfo, fileKey string) bool {
+	entry, err := findFile(meta, strings.Split(fileKey, "/")...)
+	return err == nil && entry.Hash != ""
+}
+
+// removeOrphans removes the lock files and partial downloads of files that are not part of 'meta'
+func (m *Minirepo) removeOrphans(meta *types.RepoInfo) error {
+	listed := listedIDs(meta)
+	for _, kind := range []string{locksDir, partialDir} {
+		entries, err := ioutil.ReadDir(path.Join(m.localCache, types.ReservedDir, kind))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			id := entry.Name()
+			if listed[id] {
+				continue
+			}
+			err = m.removeCacheEntry(id, func(stored *types.RepoInfo) bool {
+				return listedIDs(stored)[id]
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// listedIDs returns the IDs (see cacheFileID) of all files contained in 'meta'
+func listedIDs(meta *types.RepoInfo) map[string]bool {
+	ids := make(map[string]bool)
+	for fileKey := range flattenMeta(meta) {
+		ids[cacheFileID(fileKey)] = true
+	}
+	return ids
+}
+
+// removeCachedFile removes the cached file 'fileKey' including its partial download and lock file, see
+// removeCacheEntry
+func (m *Minirepo) removeCachedFile(fileKey string) error {
+	return m.removeCacheEntry(cacheFileID(fileKey), func(stored *types.RepoInfo) bool {
+		return isListed(stored, fileKey)
+	}, path.Join(m.localCache, fileKey))
+}
+
+// removeCacheEntry removes the partial download and the lock file with the ID 'id' as well as the cached files
+// 'files'. This waits for downloads of the file in progress. If another process sharing the cache accepted metadata
+// for which 'listed' returns true in the meantime, nothing is removed.
+func (m *Minirepo) removeCacheEntry(id string, listed func(stored *types.RepoInfo) bool, files ...string) error {
+	lockFile, err := m.internalFile(locksDir, id)
+	if err != nil {
+		return err
+	}
+	lock, err := lockPath(lockFile)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+
+	stored, err := m.storedMeta()
+	if err != nil {
+		return err
+	}
+	if stored != nil && listed(stored) {
+		return nil
+	}
+	partialFile, err := m.internalFile(partialDir, id)
+	if err != nil {
+		return err
+	}
+	for _, file := range append(files, partialFile) {
+		err = os.Remove(file)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	removeLockFile(lockFile)
+	return nil
+}
+
+// removeLockFile removes the lock file 'lockFile', which needs to be locked by the caller. This is safe, as lockPath
+// detects replaced lock files. It fails on Windows, where open files can't be removed, so the lock file is left behind
+// there.
+func removeLockFile(lockFile string) {
+	os.Remove(lockFile)
+}
+
+// storedMeta returns the metadata in the cache directory, which might be newer than the current metadata if another
+// process updated it. Returns nil if there is none. The signature isn't checked, so the result may only be used to
+// keep files.
+func (m *Minirepo) storedMeta() (*types.RepoInfo, error) {
+	var metaBin []byte
+	err := m.withCacheLock(func() error {
+		var err error
+		metaBin, err = ioutil.ReadFile(path.Join(m.localCache, "meta.yml"))
+		return err
+	})
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("metadata read failed: %s", err)
+	}
+	meta := &types.RepoInfo{}
+	err = yaml.Unmarshal(metaBin, meta)
+	if err != nil {
+		return nil, fmt.Errorf("metadata decode failed: %s", err)
+	}
+	return meta, nil
+}
+
+// evict removes the least recently used files from the cache until the size of all known files is below the maximum
+// cache size. The file 'keep' and files that are locked, e.g. as they are just being returned, are never removed.
+func (m *Minirepo) evict(state *clientState, keep string) error {
+	var size int64
+	var candidates []string
+	for fileKey, record := range state.Files {
+		size += record.Size
+		if fileKey != keep {
+			candidates = append(candidates, fileKey)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return state.Files[candidates[i]].Accessed < state.Files[candidates[j]].Accessed
+	})
+
+	for _, fileKey := range candidates {
+		if size <= m.maxCacheSize {
+			break
+		}
+		// Waiting for the lock could deadlock, as the cache lock is held already and fetchFile waits for the cache
+		// lock while holding a file lock
+		lockFile, err := m.internalFile(locksDir, cacheFileID(fileKey))
+		if err != nil {
+			return err
+		}
+		lock, err := tryLockPath(lockFile)
+		if err != nil {
+			return err
+		}
+		if lock == nil {
+			continue
+		}
+		err = os.Remove(path.Join(m.localCache, fileKey))
+		if err == nil || os.IsNotExist(err) {
+			removeLockFile(lockFile)
+		}
+		lock.Close()
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		size -= state.Files[fileKey].Size
+		delete(state.Files, fileKey)
+	}
+	return nil
+}
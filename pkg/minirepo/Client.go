@@ -18,13 +18,13 @@
 package minirepo
 
 import (
-	"bytes"
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
 	"errors"
 	"fmt"
+	log "github.com/sirupsen/logrus"
 	"github.com/uubk/minirepo/pkg/minirepo/types"
-	"golang.org/x/crypto/openpgp"
 	"gopkg.in/yaml.v2"
 	"io"
 	"io/ioutil"
@@ -33,77 +33,217 @@ import (
 	"os"
 	"path"
 	"strings"
+	"sync"
+	"time"
 )
 
-// Minirepo client
+// Minirepo client. It is safe for concurrent use, and several clients (even in different processes) may share one
+// cache directory.
 type Minirepo struct {
 	// Local cache directory
 	localCache string
-	// Remote origin URL
-	remote string
-	// ASCII-armored pubkey for signatures
-	signingKey string
+	// Mirrors of the repository, in order of preference
+	mirrors []*mirror
+	// Time a failed mirror is skipped
+	mirrorCooldown time.Duration
+	// ASCII-armored pubkeys trusted for signatures, further keys may be adopted during key rotations
+	signingKeys []string
+	// Number of trusted keys that need to sign the metadata
+	signatureThreshold int
 	// Parsed repository metadata, if available
 	meta *types.RepoInfo
+	// Protects meta
+	metaLock sync.RWMutex
+	// Protects the health of the mirrors
+	mirrorLock sync.Mutex
+	// Downloads in progress
+	downloads flightGroup
+	// Maximum size of a single downloaded file in bytes, 0 if unlimited
+	maxFileSize int64
+	// How to verify files that are already cached
+	verifyMode VerifyMode
+	// Maximum size of all cached files in bytes, 0 if unlimited
+	maxCacheSize int64
+	// Resolution of the access times used for evicting cached files. Accesses within this period aren't recorded
+	// separately, which saves writes to the state.
+	accessResolution time.Duration
+	// HTTP client used for all requests
+	httpClient *http.Client
+	// How to retry failed requests
+	retryPolicy RetryPolicy
+	// User-Agent header to send, empty for the default one
+	userAgent string
+	// Logger for diagnostic messages
+	logger log.FieldLogger
 }
 
+// VerifyMode decides how files that are already in the local cache are checked before they are returned
+type VerifyMode int
+
+const (
+	// VerifyNone returns cached files without checking them. This is the default.
+	VerifyNone VerifyMode = iota
+	// VerifyQuick compares size and modification time of cached files to the values recorded when they were
+	// downloaded. Only files whose attributes differ are hashed again.
+	VerifyQuick
+	// VerifyFull hashes cached files again every time they are requested
+	VerifyFull
+)
+
 // NewRepoClient creates a new minirepo client.
 //  - localCache is expected to contain a directory where the repository downloads should be cached
 //  - url is expected to contain a repositories upstream
 //  - key is expected to contain a full ASCII-armored GPG public key which was used for signing the metadata
+// Use NewRepoClientWithOptions for further configuration.
 func NewRepoClient(localCache, url, key string) *Minirepo {
-	obj := Minirepo{
+	obj := newRepoClient(localCache, url)
+	obj.signingKeys = []string{key}
+	return obj
+}
+
+// newRepoClient creates a new minirepo client with default settings and without signing keys
+func newRepoClient(localCache, url string) *Minirepo {
+	return &Minirepo{
 		localCache: localCache,
-		remote:     url,
-		signingKey: key,
+		mirrors: []*mirror{
+			{url: url},
+		},
+		mirrorCooldown:     5 * time.Minute,
+		signatureThreshold: 1,
+		accessResolution:   time.Hour,
+		httpClient:         http.DefaultClient,
+		retryPolicy: RetryPolicy{
+			MaxAttempts: 1,
+		},
+		logger: log.StandardLogger(),
+	}
+}
+
+// SetMaxFileSize sets the maximum size in bytes of a single file download. Downloads exceeding this size are aborted.
+// A size of 0 (the default) disables the limit.
+func (m *Minirepo) SetMaxFileSize(size int64) {
+	m.maxFileSize = size
+}
+
+// SetVerifyMode sets how files that are already cached are verified before they are returned. Cached files that fail
+// verification are downloaded again.
+func (m *Minirepo) SetVerifyMode(mode VerifyMode) {
+	m.verifyMode = mode
+}
+
+// SetMaxCacheSize sets the maximum size in bytes of all cached files. When a download exceeds this size, the least
+// recently used files are removed from the cache. Accesses are tracked with a resolution of one hour. A size of 0 (the
+// default) disables the limit.
+func (m *Minirepo) SetMaxCacheSize(size int64) {
+	m.maxCacheSize = size
+}
+
+// SetSignatureThreshold sets how many different trusted keys need to sign the metadata for it to be accepted. The
+// default is 1. Values smaller than 1 are treated as 1.
+func (m *Minirepo) SetSignatureThreshold(threshold int) {
+	if threshold < 1 {
+		threshold = 1
+	}
+	m.signatureThreshold = threshold
+}
+
+// SetHTTPClient sets the HTTP client used for all requests, e.g. in order to configure timeouts, proxies or TLS
+func (m *Minirepo) SetHTTPClient(client *http.Client) {
+	m.httpClient = client
+}
+
+// SetTransport sets the transport used for all requests. This replaces any HTTP client set before.
+func (m *Minirepo) SetTransport(transport http.RoundTripper) {
+	m.httpClient = &http.Client{
+		Transport: transport,
 	}
-	return &obj
 }
 
+// UpdateResult describes the outcome of TryUpdate
+type UpdateResult int
+
+const (
+	// NotUpdated means that the metadata couldn't be fetched and the local copy was loaded instead
+	NotUpdated UpdateResult = iota
+	// Unchanged means that the repository confirmed that the local copy is up to date
+	Unchanged
+	// Updated means that new metadata was fetched
+	Updated
+)
+
 // TryUpdate will try to update the repository and load the metadata if either the repository was updated or a local
-// copy is available.
-func (m *Minirepo) TryUpdate() (bool, error) {
+// copy is available. Metadata is only downloaded if it changed since the last update.
+func (m *Minirepo) TryUpdate() (UpdateResult, error) {
+	return m.TryUpdateContext(context.Background())
+}
+
+// TryUpdateContext is like TryUpdate, but aborts the metadata download when 'ctx' is done
+func (m *Minirepo) TryUpdateContext(ctx context.Context) (UpdateResult, error) {
 	_, err := os.Stat(path.Join(m.localCache, "meta.yml"))
 	haveLocal := err == nil
 
-	err = m.fetchMeta()
+	result, err := m.fetchMeta(ctx, haveLocal)
 	if err != nil {
 		if !haveLocal {
-			return false, fmt.Errorf("fetch failed and no local copy: %s", err)
+			return NotUpdated, fmt.Errorf("fetch failed and no local copy: %w", err)
+		}
+		return result, m.decodeMeta()
+	}
+	if result == Updated {
+		// The fetched metadata was verified and loaded already
+		return result, nil
+	}
+
+	// The local copy is up to date, so it only needs to be loaded if this didn't happen yet. Another process sharing
+	// the cache might have replaced it since it was loaded, though.
+	meta := m.currentMeta()
+	if meta != nil {
+		state, err := m.loadState()
+		if err == nil && meta.Timestamp.Equal(state.Timestamp) {
+			return result, nil
 		}
 	}
-	fetchSuccessful := err == nil
+	return result, m.decodeMeta()
+}
 
-	return fetchSuccessful, m.decodeMeta()
+// currentMeta returns the metadata currently in use, nil if none was loaded yet
+func (m *Minirepo) currentMeta() *types.RepoInfo {
+	m.metaLock.RLock()
+	defer m.metaLock.RUnlock()
+	return m.meta
+}
+
+// setMeta replaces the metadata currently in use
+func (m *Minirepo) setMeta(meta *types.RepoInfo) {
+	m.metaLock.Lock()
+	defer m.metaLock.Unlock()
+	m.meta = meta
 }
 
 // GetFileLatest returns the *latest* version of a file, that is, it deletes a local copy before download, should it exist
 func (m *Minirepo) GetFileLatest(filePath ...string) (bool, string, error) {
+	return m.GetFileLatestContext(context.Background(), filePath...)
+}
+
+// GetFileLatestContext is like GetFileLatest, but aborts the download when 'ctx' is done
+func (m *Minirepo) GetFileLatestContext(ctx context.Context, filePath ...string) (bool, string, error) {
 	fileFullPath := []string{m.localCache}
 	fileFullPath = append(fileFullPath, filePath...)
-	fileRef := path.Join(fileFullPath...)
-	_, err := os.Stat(fileRef)
-	if err == nil {
-		err = os.Remove(fileRef)
-		if err != nil {
-			return true, fileRef, errors.New("deletion of old file failed")
-		}
-		fileRef, err := m.GetFile(filePath...)
-		return true, fileRef, err
-	}
-	fileRef, err = m.GetFile(filePath...)
-	return false, fileRef, err
+	_, err := os.Stat(path.Join(fileFullPath...))
+	existed := err == nil
+	fileRef, err := m.getFile(ctx, true, filePath...)
+	return existed, fileRef, err
 }
 
-// findFile searches for the file in the repositories metadata section
-func (m *Minirepo) findFile(filePath ...string) (*types.DirEntry, error) {
+// findFile searches for the file in the metadata section 'meta'
+func findFile(meta *types.RepoInfo, filePath ...string) (*types.DirEntry, error) {
 	var curEntry *types.DirEntry
 	for _, item := range filePath {
 		if item == "" {
 			return nil, errors.New("invalid path part: empty string")
 		}
 		if curEntry == nil {
-			for _, otherItem := range m.meta.Contents {
+			for _, otherItem := range meta.Contents {
 				if otherItem.Name == item {
 					curEntry = &otherItem
 					break
@@ -111,7 +251,7 @@ func (m *Minirepo) findFile(filePath ...string) (*types.DirEntry, error) {
 			}
 			if curEntry == nil {
 				// Didn't find anything
-				return nil, errors.New("file not found")
+				return nil, ErrNotFound
 			}
 		} else {
 			found := false
@@ -123,7 +263,7 @@ func (m *Minirepo) findFile(filePath ...string) (*types.DirEntry, error) {
 				}
 			}
 			if !found {
-				return nil, errors.New("file not found")
+				return nil, ErrNotFound
 			}
 		}
 	}
@@ -133,98 +273,381 @@ func (m *Minirepo) findFile(filePath ...string) (*types.DirEntry, error) {
 
 // GetFile returns a local path to the file requested if possible
 func (m *Minirepo) GetFile(filePath ...string) (string, error) {
-	if m.meta == nil {
-		return "", errors.New("no metadata available")
+	return m.GetFileContext(context.Background(), filePath...)
+}
+
+// GetFileContext is like GetFile, but returns once 'ctx' is done. Concurrent requests for the same file share a single
+// download, which is aborted once all of them are done.
+func (m *Minirepo) GetFileContext(ctx context.Context, filePath ...string) (string, error) {
+	return m.getFile(ctx, false, filePath...)
+}
+
+// getFile implements GetFileContext and GetFileLatestContext. If 'latest' is set, a local copy is discarded.
+func (m *Minirepo) getFile(ctx context.Context, latest bool, filePath ...string) (string, error) {
+	meta := m.currentMeta()
+	if meta == nil {
+		return "", ErrNoMetadata
+	}
+	if isExpired(meta) {
+		return "", ErrMetadataExpired
 	}
 
 	if len(filePath) == 0 {
 		return "", errors.New("no path specified")
 	}
+	if filePath[0] == types.ReservedDir {
+		// Older servers might publish it, but it would clash with the internal files of the cache
+		return "", ErrNotFound
+	}
 
 	// Find file in metadata
-	curEntry, err := m.findFile(filePath...)
+	curEntry, err := findFile(meta, filePath...)
 	if err != nil {
 		return "", err
 	}
 
-	// Did we already fetch this file?
+	// Concurrent requests for the same version of a file share a single download
+	flightKey := strings.Join(filePath, "/") + "@" + curEntry.Hash
+	if latest {
+		flightKey += "!latest"
+	}
+	return m.downloads.do(ctx, flightKey, func(ctx context.Context) (string, error) {
+		return m.fetchFile(ctx, curEntry, latest, filePath...)
+	})
+}
+
+// fetchFile returns a local path to the file 'filePath' described by 'curEntry', downloading it if necessary. If
+// 'latest' is set, a local copy is discarded and the file is downloaded again.
+func (m *Minirepo) fetchFile(ctx context.Context, curEntry *types.DirEntry, latest bool,
+	filePath ...string) (string, error) {
 	fileFullPath := []string{m.localCache}
 	fileFullPath = append(fileFullPath, filePath...)
 	fileRef := path.Join(fileFullPath...)
-	_, err = os.Stat(fileRef)
+	fileKey := strings.Join(filePath, "/")
+
+	// Other processes sharing the cache might fetch the same file, so hold its lock until we are done
+	os.MkdirAll(path.Dir(fileRef), 0700)
+	lockFile, err := m.internalFile(locksDir, cacheFileID(fileKey))
+	if err != nil {
+		return fileRef, err
+	}
+	lock, err := lockPath(lockFile)
+	if err != nil {
+		return fileRef, err
+	}
+	defer lock.Close()
+
+	if latest {
+		err = os.Remove(fileRef)
+		if err != nil && !os.IsNotExist(err) {
+			return fileRef, fmt.Errorf("deletion of old file failed: %w", err)
+		}
+	}
+
+	// Did we already fetch this file?
+	info, err := os.Stat(fileRef)
 	if err == nil {
-		return fileRef, nil
+		valid, err := m.checkCachedFile(fileRef, fileKey, info, curEntry)
+		if err != nil {
+			return fileRef, err
+		}
+		if valid {
+			return fileRef, nil
+		}
+		// Cached copy is outdated or damaged -> discard it and fetch it again
+		err = os.Remove(fileRef)
+		if err != nil {
+			return fileRef, err
+		}
 	}
 
 	// Nope, file does not exist -> fetch it and check signature
-	fileUrl := m.remote
+	fileUrl := ""
 	for _, segment := range filePath {
 		fileUrl += "/" + url.PathEscape(segment)
 	}
-	response, err := http.Get(fileUrl)
+	tempRef, err := m.internalFile(partialDir, cacheFileID(fileKey))
 	if err != nil {
-		return "", fmt.Errorf("file download failed: %s", err)
+		return fileRef, err
 	}
-	defer response.Body.Close()
-	os.MkdirAll(path.Dir(fileRef), 0700)
-	fileContent, err := ioutil.ReadAll(response.Body)
+	fd, err := os.OpenFile(tempRef, os.O_CREATE|os.O_RDWR, 0600)
 	if err != nil {
-		return "", fmt.Errorf("file download failed: %s", err)
+		return fileRef, err
 	}
+	defer fd.Close()
 
-	hash := sha256.New()
-	_, err = io.Copy(hash, bytes.NewReader(fileContent))
+	err = m.eachMirror(ctx, func(base string) error {
+		return m.retry(ctx, base+fileUrl, func() error {
+			return m.download(ctx, base+fileUrl, fd, curEntry)
+		})
+	})
 	if err != nil {
-		return "", fmt.Errorf("checksum comparison failed")
+		if !isTemporary(err) && ctx.Err() == nil {
+			// The partial file is broken, don't try to resume it
+			os.Remove(tempRef)
+		}
+		return "", err
+	}
+	err = fd.Close()
+	if err != nil {
+		return fileRef, err
+	}
+	err = os.Rename(tempRef, fileRef)
+	if err != nil {
+		return fileRef, err
+	}
+	return fileRef, m.recordFile(fileRef, fileKey, curEntry.Hash)
+}
+
+// checkCachedFile checks whether the cached file 'fileRef' with attributes 'info' can be returned for 'entry'. The file
+// is considered stale if it was downloaded for a different hash than the one in the current metadata, other checks
+// depend on the verify mode. If the file can be returned and a maximum cache size is set, it is marked as used.
+func (m *Minirepo) checkCachedFile(fileRef, fileKey string, info os.FileInfo, entry *types.DirEntry) (bool, error) {
+	state, err := m.loadState()
+	if err != nil {
+		return false, err
+	}
+	record, known := state.Files[fileKey]
+	if known && record.Hash != entry.Hash {
+		// The file changed upstream since we downloaded it
+		return false, nil
+	}
+	verified := known && m.verifyMode == VerifyNone
+	if !verified && entry.Size != nil && info.Size() != *entry.Size {
+		return false, nil
+	}
+	if !verified && known && m.verifyMode == VerifyQuick {
+		verified = record.Size == info.Size() && record.MTime == info.ModTime().UnixNano()
 	}
 
-	hashSum := hex.EncodeToString(hash.Sum(nil))
-	if hashSum != curEntry.Hash || hashSum == "" {
-		return "", fmt.Errorf("checksum mismatch")
+	if !verified {
+		// Either verification was requested or we don't know which version of the file this is (it was downloaded
+		// by an older client), so hash it
+		hashSum, err := hashLocalFile(fileRef)
+		if err != nil || hashSum != entry.Hash {
+			return false, nil
+		}
+		// File is fine, remember its current attributes for the next time
+		record = cachedFile{
+			Hash:  hashSum,
+			Size:  info.Size(),
+			MTime: info.ModTime().UnixNano(),
+		}
 	}
-	return fileRef, ioutil.WriteFile(fileRef, fileContent, 0600)
+
+	// Only write the state if something changed, as cache hits are the common case
+	now := time.Now()
+	used := m.maxCacheSize > 0 && now.Sub(time.Unix(0, record.Accessed)) >= m.accessResolution
+	if verified && !used {
+		return true, nil
+	}
+	record.Accessed = now.UnixNano()
+	err = m.updateState(func(state *clientState) error {
+		state.Files[fileKey] = record
+		return nil
+	})
+	return err == nil, err
 }
 
-// decodeMeta decodes a local copy of the metadata file
-func (m *Minirepo) decodeMeta() error {
-	metaBin, err := ioutil.ReadFile(path.Join(m.localCache, "meta.yml"))
+// recordFile remembers the attributes of the freshly downloaded file 'fileRef' and the hash it was verified against.
+// If a maximum cache size is set, other files are evicted as needed.
+func (m *Minirepo) recordFile(fileRef, fileKey, hash string) error {
+	info, err := os.Stat(fileRef)
 	if err != nil {
-		return fmt.Errorf("metadata read failed: %s", err)
+		return err
 	}
-	m.meta = &types.RepoInfo{}
-	return yaml.Unmarshal(metaBin, &m.meta)
+	return m.updateState(func(state *clientState) error {
+		state.Files[fileKey] = cachedFile{
+			Hash:     hash,
+			Size:     info.Size(),
+			MTime:    info.ModTime().UnixNano(),
+			Accessed: time.Now().UnixNano(),
+		}
+		if m.maxCacheSize > 0 {
+			return m.evict(state, fileKey)
+		}
+		return nil
+	})
 }
 
-// fetchMeta fetches current metadata and write it to disk if and only if the signature is valid
-func (m *Minirepo) fetchMeta() error {
-	response, err := http.Get(m.remote + "/meta.yml")
+// hashLocalFile calculates the SHA-256 hash of 'file', returning it in Hex encoding
+func hashLocalFile(file string) (string, error) {
+	fd, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer fd.Close()
+	hash := sha256.New()
+	_, err = io.Copy(hash, fd)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// decodeMeta decodes a local copy of the metadata file after verifying its signature
+func (m *Minirepo) decodeMeta() error {
+	var metaBin, metaAsc []byte
+	var state *clientState
+	var history []signedMeta
+	// Another process might be replacing the metadata right now, so make sure to read a consistent copy
+	err := m.withCacheLock(func() error {
+		var err error
+		metaBin, err = ioutil.ReadFile(path.Join(m.localCache, "meta.yml"))
+		if err != nil {
+			return fmt.Errorf("metadata read failed: %s", err)
+		}
+		metaAsc, err = ioutil.ReadFile(path.Join(m.localCache, "meta.asc"))
+		if err != nil {
+			return fmt.Errorf("metadata signature read failed: %s", err)
+		}
+		history, err = m.loadKeyHistory()
+		if err != nil {
+			return err
+		}
+		state, err = m.loadState()
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	trust, err := m.trustedKeys(history)
+	if err != nil {
+		return err
+	}
+	_, err = trust.verify(metaBin, metaAsc, m.signatureThreshold)
 	if err != nil {
-		return fmt.Errorf("metadata download failed: %s", err)
+		return err
 	}
-	defer response.Body.Close()
-	metaYml, err := ioutil.ReadAll(response.Body)
+	meta := &types.RepoInfo{}
+	err = yaml.Unmarshal(metaBin, meta)
 	if err != nil {
-		return fmt.Errorf("metadata download failed: %s", err)
+		return fmt.Errorf("metadata decode failed: %s", err)
 	}
-	response, err = http.Get(m.remote + "/meta.asc")
+	err = checkRollback(meta, state)
 	if err != nil {
-		return fmt.Errorf("metadata download failed: %s", err)
+		return err
 	}
-	defer response.Body.Close()
-	metaAsc, err := ioutil.ReadAll(response.Body)
+	m.setMeta(meta)
+	return nil
+}
+
+// checkRollback ensures that 'meta' isn't older than the newest metadata accepted so far
+func checkRollback(meta *types.RepoInfo, state *clientState) error {
+	if meta.Timestamp.Before(state.Timestamp) {
+		return fmt.Errorf("%w: metadata from %s is older than accepted metadata from %s", ErrRollback,
+			meta.Timestamp, state.Timestamp)
+	}
+	return nil
+}
+
+// isExpired checks whether 'meta' has an expiry date that has passed
+func isExpired(meta *types.RepoInfo) bool {
+	return meta.Expires != nil && time.Now().After(*meta.Expires)
+}
+
+// fetchMeta fetches current metadata from the first mirror that provides valid metadata. If 'haveLocal' is set,
+// the metadata is only downloaded if it changed since the local copy was fetched.
+func (m *Minirepo) fetchMeta(ctx context.Context, haveLocal bool) (UpdateResult, error) {
+	result := NotUpdated
+	err := m.eachMirror(ctx, func(base string) error {
+		var err error
+		result, err = m.fetchMetaFrom(ctx, base, haveLocal)
+		return err
+	})
+	return result, err
+}
+
+// fetchMetaFrom fetches current metadata from the mirror at 'base' and writes it to disk if and only if the signature
+// is valid. Metadata that is older than the metadata accepted previously or already expired is rejected, accepted
+// metadata is loaded.
+func (m *Minirepo) fetchMetaFrom(ctx context.Context, base string, haveLocal bool) (UpdateResult, error) {
+	state, err := m.loadState()
 	if err != nil {
-		return fmt.Errorf("metadata download failed: %s", err)
+		return NotUpdated, err
+	}
+	// Validators are only meaningful for the mirror the local copy was fetched from
+	header := http.Header{}
+	if haveLocal && state.MetaSource == base {
+		if state.ETag != "" {
+			header.Set("If-None-Match", state.ETag)
+		}
+		if state.LastModified != "" {
+			header.Set("If-Modified-Since", state.LastModified)
+		}
 	}
 
-	// We have both metadata and signature. Verify signature before opening metadata file!!
-	keyring, err := openpgp.ReadArmoredKeyRing(strings.NewReader(m.signingKey))
+	metaYml, metaHeader, err := m.fetchAll(ctx, base+"/meta.yml", header)
+	var statusErr *HTTPStatusError
+	if errors.As(err, &statusErr) && statusErr.Code == http.StatusNotModified {
+		return Unchanged, nil
+	}
 	if err != nil {
-		return fmt.Errorf("keyring decode failed: %s", err)
+		return NotUpdated, fmt.Errorf("metadata download failed: %w", err)
 	}
-	_, err = openpgp.CheckArmoredDetachedSignature(keyring, bytes.NewReader(metaYml), bytes.NewReader(metaAsc))
+	metaAsc, _, err := m.fetchAll(ctx, base+"/meta.asc", nil)
 	if err != nil {
-		return fmt.Errorf("signature invalid or check failed: %s", err)
+		return NotUpdated, fmt.Errorf("metadata download failed: %w", err)
 	}
 
-	return ioutil.WriteFile(path.Join(m.localCache, "meta.yml"), metaYml, 0600)
+	meta := &types.RepoInfo{}
+	err = m.updateState(func(state *clientState) error {
+		// Check against the current state, another process might have accepted newer metadata in the meantime
+		history, err := m.loadKeyHistory()
+		if err != nil {
+			return err
+		}
+		trust, err := m.trustedKeys(history)
+		if err != nil {
+			return err
+		}
+		// We have both metadata and signature. Verify signature before opening metadata file!!
+		signers, err := trust.verify(metaYml, metaAsc, m.signatureThreshold)
+		if err != nil {
+			return err
+		}
+		err = yaml.Unmarshal(metaYml, meta)
+		if err != nil {
+			return fmt.Errorf("metadata decode failed: %s", err)
+		}
+		if isExpired(meta) {
+			return ErrMetadataExpired
+		}
+		err = checkRollback(meta, state)
+		if err != nil {
+			return err
+		}
+		if trust.update(meta, metaYml, metaAsc, signers, m.logger) {
+			// Keep the metadata, so that the key changes can be verified whenever the trusted keys are needed
+			err = m.saveKeyHistory(append(history, signedMeta{Meta: string(metaYml), Signature: string(metaAsc)}))
+			if err != nil {
+				return err
+			}
+		}
+		// Keep the signature so that the local copy can be verified when loading it
+		err = m.saveMeta(metaYml, metaAsc)
+		if err != nil {
+			return err
+		}
+		state.Timestamp = meta.Timestamp
+		state.MetaSource = base
+		state.ETag = metaHeader.Get("ETag")
+		state.LastModified = ""
+		lastModified, err := http.ParseTime(metaHeader.Get("Last-Modified"))
+		if err == nil {
+			// Last-Modified has a resolution of one second. If the metadata was served within the second it was
+			// modified in, it might be modified again without changing the header, so it can't be used as a
+			// validator.
+			date, err := http.ParseTime(metaHeader.Get("Date"))
+			if err == nil && date.After(lastModified) {
+				state.LastModified = metaHeader.Get("Last-Modified")
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return NotUpdated, err
+	}
+	m.setMeta(meta)
+	return Updated, nil
 }
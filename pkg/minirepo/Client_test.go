@@ -17,19 +17,31 @@
 package minirepo
 
 import (
+	"bytes"
+	"context"
 	"crypto/rand"
-	"github.com/uubk/minirepo/internal/minirepo"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/uubk/minirepo/pkg/minirepo/server"
+	"github.com/uubk/minirepo/pkg/minirepo/types"
 	"golang.org/x/sys/unix"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"path"
+	"path/filepath"
 	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
 )
 
-func generateTestAssets(dir string) {
+func generateTestAssets(dir string) error {
 	err := os.MkdirAll(path.Join(dir, "repo"), 0700)
 	if err != nil {
 		panic(err)
@@ -40,14 +52,48 @@ func generateTestAssets(dir string) {
 	}
 
 	repoRoot := path.Join(dir, "repo")
-	svc := minirepo.NewServer(dir, repoRoot, "Unittest Server")
-	svc.GenerateKeypair()
-	svc.LoadKeypair()
+	svc := server.NewServer(dir, repoRoot, "Unittest Server")
+	// ECDSA keys are much faster to generate than the default RSA keys
+	svc.SetKeyAlgorithm(server.KeyECDSAP256)
+	err = svc.GenerateKeypair()
+	if err != nil {
+		return err
+	}
+	err = svc.LoadKeypair()
+	if err != nil {
+		return err
+	}
 
 	randomData := make([]byte, 256)
 	rand.Read(randomData)
 	ioutil.WriteFile(path.Join(repoRoot, "a_dir", "testfile"), randomData, 0700)
-	svc.UpdateMetadata()
+	_, err = svc.UpdateMetadata()
+	return err
+}
+
+// updateTestAssets regenerates the metadata of the repository backing 'client'
+func updateTestAssets(client *Minirepo, validity time.Duration) error {
+	testPath := path.Dir(client.localCache)
+	svc := server.NewServer(testPath, path.Join(testPath, "repo"), "Unittest Server")
+	svc.SetValidity(validity)
+	err := svc.LoadKeypair()
+	if err != nil {
+		return err
+	}
+	_, err = svc.UpdateMetadata()
+	return err
+}
+
+// forgetValidators removes the validators of the local copy of the metadata, so that the next update fetches the
+// metadata even if it didn't change
+func forgetValidators(client *Minirepo) error {
+	state, err := client.loadState()
+	if err != nil {
+		return err
+	}
+	state.ETag = ""
+	state.LastModified = ""
+	return client.saveState(state)
 }
 
 func provideTestServer(root string) (string, *http.Server) {
@@ -74,7 +120,10 @@ func InitTestClient() (*Minirepo, *http.Server, error) {
 	if err != nil {
 		return nil, nil, err
 	}
-	generateTestAssets(testPath)
+	err = generateTestAssets(testPath)
+	if err != nil {
+		return nil, nil, err
+	}
 	pubkeyBin, err := ioutil.ReadFile(path.Join(testPath, "pub.asc"))
 	if err != nil {
 		return nil, nil, err
@@ -146,6 +195,50 @@ func TestFileDownloadFresh(t *testing.T) {
 	}
 }
 
+func TestFileDownloadFreshConcurrent(t *testing.T) {
+	client, server, err := InitTestClient()
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	defer server.Shutdown(nil)
+
+	// A second client sharing the cache acts like another process
+	pubkeyBin, err := ioutil.ReadFile(path.Join(path.Dir(client.localCache), "pub.asc"))
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	otherClient := NewRepoClient(client.localCache, client.mirrors[0].url, string(pubkeyBin))
+	_, err = otherClient.TryUpdate()
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 640)
+	for i := 0; i < 8; i++ {
+		for _, item := range []*Minirepo{client, otherClient} {
+			wg.Add(1)
+			go func(item *Minirepo) {
+				defer wg.Done()
+				for j := 0; j < 20; j++ {
+					_, _, err := item.GetFileLatest("a_dir", "testfile")
+					errs <- err
+					_, err = item.GetFile("a_dir", "testfile")
+					errs <- err
+				}
+			}(item)
+		}
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Fatal("Unexpected error: ", err)
+		}
+	}
+}
+
 func TestFileDownloadErrors(t *testing.T) {
 	client, server, err := InitTestClient()
 	if err != nil {
@@ -227,7 +320,7 @@ func TestFileDownloadErrorsPermissions(t *testing.T) {
 	filePath, err = client.GetFile("a_dir", "testfile")
 	if err == nil {
 		t.Fatal("Expected error missing")
-	} else if err.Error() != "open /proc/a_dir/testfile: no such file or directory" {
+	} else if err.Error() != "open /proc/a_dir/testfile.lock: no such file or directory" {
 		t.Fatal("Unxpected error: ", err)
 	}
 	if filePath == "" {
@@ -244,10 +337,1480 @@ func TestTryUpdate(t *testing.T) {
 	server.Shutdown(nil)
 
 	isFresh, err := client.TryUpdate()
-	if isFresh {
+	if isFresh != NotUpdated {
 		t.Fatal("Metadata should have been cached copy")
 	}
 	if err != nil {
 		t.Fatal("Unexpected error")
 	}
 }
+
+func TestFileDownloadSignedSize(t *testing.T) {
+	client, server, err := InitTestClient()
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	defer server.Shutdown(nil)
+
+	entry := &client.meta.Contents[0].Children[0]
+	if entry.Size == nil || *entry.Size != 256 {
+		t.Fatal("Unexpected size in metadata: ", entry.Size)
+	}
+
+	// Pretend the metadata announced a smaller file
+	*entry.Size = 128
+	filePath, err := client.GetFile("a_dir", "testfile")
+	if err == nil {
+		t.Fatal("Expected error missing")
+	} else if !errors.Is(err, ErrSizeMismatch) {
+		t.Fatal("Unxpected error: ", err)
+	}
+	if filePath != "" {
+		t.Fatal("Unexpectedly got a path?")
+	}
+}
+
+func TestFileDownloadSignedSizeEmpty(t *testing.T) {
+	client, server, err := InitTestClient()
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	defer server.Shutdown(nil)
+
+	// An empty file needs to stay empty, even though its size is 0
+	repoRoot := path.Join(path.Dir(client.localCache), "repo")
+	err = ioutil.WriteFile(path.Join(repoRoot, "a_dir", "empty"), nil, 0600)
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	err = updateTestAssets(client, 0)
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	_, err = client.TryUpdate()
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	_, err = client.GetFile("a_dir", "empty")
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+
+	err = ioutil.WriteFile(path.Join(repoRoot, "a_dir", "empty"), make([]byte, 256), 0600)
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	_, _, err = client.GetFileLatest("a_dir", "empty")
+	if !errors.Is(err, ErrSizeMismatch) {
+		t.Fatal("Unxpected error: ", err)
+	}
+}
+
+func TestMetaRollback(t *testing.T) {
+	client, server, err := InitTestClient()
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	defer server.Shutdown(nil)
+
+	// Keep a copy of the current metadata
+	repoRoot := path.Join(path.Dir(client.localCache), "repo")
+	oldMeta := map[string][]byte{}
+	for _, file := range []string{"meta.yml", "meta.asc"} {
+		oldMeta[file], err = ioutil.ReadFile(path.Join(repoRoot, file))
+		if err != nil {
+			t.Fatal("Unexpected error: ", err)
+		}
+	}
+
+	err = updateTestAssets(client, 0)
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	_, err = client.fetchMeta(context.Background(), false)
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+
+	// Replay the old metadata
+	for file, content := range oldMeta {
+		err = ioutil.WriteFile(path.Join(repoRoot, file), content, 0600)
+		if err != nil {
+			t.Fatal("Unexpected error: ", err)
+		}
+	}
+	_, err = client.fetchMeta(context.Background(), false)
+	if err == nil {
+		t.Fatal("Expected error missing")
+	} else if !strings.HasPrefix(err.Error(), "metadata rollback detected") {
+		t.Fatal("Unxpected error: ", err)
+	}
+}
+
+func TestMetaExpiry(t *testing.T) {
+	client, server, err := InitTestClient()
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	defer server.Shutdown(nil)
+
+	err = updateTestAssets(client, time.Hour)
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	_, err = client.fetchMeta(context.Background(), false)
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	err = client.decodeMeta()
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	if client.meta.Expires == nil {
+		t.Fatal("Metadata should have an expiry date")
+	}
+
+	// Pretend the metadata expired
+	expired := time.Now().Add(-time.Minute)
+	client.meta.Expires = &expired
+	filePath, err := client.GetFile("a_dir", "testfile")
+	if err == nil {
+		t.Fatal("Expected error missing")
+	} else if err.Error() != "metadata expired" {
+		t.Fatal("Unxpected error: ", err)
+	}
+	if filePath != "" {
+		t.Fatal("Unexpectedly got a path?")
+	}
+}
+
+func TestTryUpdateTamperedCache(t *testing.T) {
+	client, server, err := InitTestClient()
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	server.Shutdown(nil)
+
+	metaFile := path.Join(client.localCache, "meta.yml")
+	metaBin, err := ioutil.ReadFile(metaFile)
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	err = ioutil.WriteFile(metaFile, []byte(strings.Replace(string(metaBin), "hash: ", "hash: 00", 1)), 0600)
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+
+	_, err = client.TryUpdate()
+	if err == nil {
+		t.Fatal("Expected error missing")
+	} else if !strings.HasPrefix(err.Error(), "signature invalid or check failed") {
+		t.Fatal("Unxpected error: ", err)
+	}
+}
+
+func TestTryUpdateFailedWrite(t *testing.T) {
+	client, server, err := InitTestClient()
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	defer server.Shutdown(nil)
+	oldMeta := client.currentMeta()
+
+	// Writing the new signature succeeds, but writing the new metadata fails
+	tempFile := path.Join(client.localCache, "meta.yml.tmp")
+	err = os.Mkdir(tempFile, 0700)
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	err = updateTestAssets(client, 0)
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	_, err = client.fetchMeta(context.Background(), false)
+	if err == nil {
+		t.Fatal("Expected error missing")
+	}
+	os.Remove(tempFile)
+
+	// The local copy is still intact
+	err = client.decodeMeta()
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	if !client.currentMeta().Timestamp.Equal(oldMeta.Timestamp) {
+		t.Fatal("Unexpected metadata: ", client.currentMeta().Timestamp)
+	}
+}
+
+func TestFileVerifyCached(t *testing.T) {
+	client, server, err := InitTestClient()
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	defer server.Shutdown(nil)
+
+	filePath, err := client.GetFile("a_dir", "testfile")
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	original, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	info, err := os.Stat(filePath)
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	tamper := func() {
+		err := ioutil.WriteFile(filePath, make([]byte, len(original)), 0600)
+		if err != nil {
+			t.Fatal("Unexpected error: ", err)
+		}
+		// Keep the modification time so that only hashing can detect the change
+		err = os.Chtimes(filePath, info.ModTime(), info.ModTime())
+		if err != nil {
+			t.Fatal("Unexpected error: ", err)
+		}
+	}
+	isOriginal := func() bool {
+		content, err := ioutil.ReadFile(filePath)
+		if err != nil {
+			t.Fatal("Unexpected error: ", err)
+		}
+		return bytes.Equal(content, original)
+	}
+
+	tamper()
+	client.SetVerifyMode(VerifyNone)
+	_, err = client.GetFile("a_dir", "testfile")
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	if isOriginal() {
+		t.Fatal("File shouldn't have been checked")
+	}
+
+	client.SetVerifyMode(VerifyQuick)
+	_, err = client.GetFile("a_dir", "testfile")
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	if isOriginal() {
+		t.Fatal("File shouldn't have been hashed as size and modification time match")
+	}
+
+	client.SetVerifyMode(VerifyFull)
+	_, err = client.GetFile("a_dir", "testfile")
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	if !isOriginal() {
+		t.Fatal("File should have been downloaded again")
+	}
+
+	info, err = os.Stat(filePath)
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	tamper()
+	// A different modification time should trigger hashing
+	err = os.Chtimes(filePath, time.Now(), time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	client.SetVerifyMode(VerifyQuick)
+	_, err = client.GetFile("a_dir", "testfile")
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	if !isOriginal() {
+		t.Fatal("File should have been downloaded again")
+	}
+}
+
+func TestFileChangedUpstream(t *testing.T) {
+	client, server, err := InitTestClient()
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	defer server.Shutdown(nil)
+
+	filePath, err := client.GetFile("a_dir", "testfile")
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+
+	// Publish a new version of the file
+	newData := make([]byte, 512)
+	rand.Read(newData)
+	err = ioutil.WriteFile(path.Join(path.Dir(client.localCache), "repo", "a_dir", "testfile"), newData, 0600)
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	err = updateTestAssets(client, 0)
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	_, err = client.TryUpdate()
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+
+	filePath, err = client.GetFile("a_dir", "testfile")
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	content, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	if !bytes.Equal(content, newData) {
+		t.Fatal("Stale file was returned")
+	}
+}
+
+// addTestFiles adds random files of 256 bytes to the repository backing 'client' and updates the client's metadata
+func addTestFiles(client *Minirepo, files ...string) error {
+	for _, file := range files {
+		filePath := path.Join(path.Dir(client.localCache), "repo", file)
+		err := os.MkdirAll(path.Dir(filePath), 0700)
+		if err != nil {
+			return err
+		}
+		randomData := make([]byte, 256)
+		rand.Read(randomData)
+		err = ioutil.WriteFile(filePath, randomData, 0600)
+		if err != nil {
+			return err
+		}
+	}
+	err := updateTestAssets(client, 0)
+	if err != nil {
+		return err
+	}
+	_, err = client.TryUpdate()
+	return err
+}
+
+func TestGC(t *testing.T) {
+	client, server, err := InitTestClient()
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	defer server.Shutdown(nil)
+
+	_, err = client.GetFile("a_dir", "testfile")
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	for _, file := range []string{"a_dir/other", "old_dir/sub/stale"} {
+		filePath := path.Join(client.localCache, file)
+		os.MkdirAll(path.Dir(filePath), 0700)
+		err = ioutil.WriteFile(filePath, []byte("stale"), 0600)
+		if err != nil {
+			t.Fatal("Unexpected error: ", err)
+		}
+	}
+
+	err = client.GC()
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	for _, file := range []string{"a_dir/testfile", "meta.yml", "meta.asc", "state.yml"} {
+		_, err = os.Stat(path.Join(client.localCache, file))
+		if err != nil {
+			t.Fatal("File shouldn't have been removed: ", err)
+		}
+	}
+	for _, file := range []string{"a_dir/other", "old_dir"} {
+		_, err = os.Stat(path.Join(client.localCache, file))
+		if !os.IsNotExist(err) {
+			t.Fatal("File should have been removed: ", file)
+		}
+	}
+}
+
+func TestGCSharedCache(t *testing.T) {
+	client, server, err := InitTestClient()
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	defer server.Shutdown(nil)
+
+	// Another client sharing the cache fetches newer metadata and a file that the first client doesn't know
+	pubkeyBin, err := ioutil.ReadFile(path.Join(path.Dir(client.localCache), "pub.asc"))
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	otherClient := NewRepoClient(client.localCache, client.mirrors[0].url, string(pubkeyBin))
+	repoRoot := path.Join(path.Dir(client.localCache), "repo")
+	err = ioutil.WriteFile(path.Join(repoRoot, "a_dir", "new"), []byte("new"), 0600)
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	err = updateTestAssets(client, 0)
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	_, err = otherClient.TryUpdate()
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	_, err = otherClient.GetFile("a_dir", "new")
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+
+	// A file that isn't listed anywhere is only removed once nobody downloads it anymore
+	partialFile, err := client.internalFile(partialDir, cacheFileID("a_dir/stale"))
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	err = ioutil.WriteFile(partialFile, []byte("stale"), 0600)
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	lockFile, err := client.internalFile(locksDir, cacheFileID("a_dir/stale"))
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	lock, err := lockPath(lockFile)
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	done := make(chan error)
+	go func() {
+		done <- client.GC()
+	}()
+	select {
+	case err = <-done:
+		t.Fatal("GC should have waited for the download: ", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	lock.Close()
+	err = <-done
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+
+	_, err = os.Stat(path.Join(client.localCache, "a_dir", "new"))
+	if err != nil {
+		t.Fatal("File of newer metadata shouldn't have been removed: ", err)
+	}
+	_, err = os.Stat(partialFile)
+	if !os.IsNotExist(err) {
+		t.Fatal("Partial file should have been removed: ", err)
+	}
+}
+
+func TestGCInternalNames(t *testing.T) {
+	client, server, err := InitTestClient()
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	defer server.Shutdown(nil)
+
+	// Files named like the internal files of other files are ordinary files
+	err = addTestFiles(client, "a_dir/pkg.lock", "a_dir/pkg.part")
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	for _, file := range []string{"pkg.lock", "pkg.part"} {
+		_, err = client.GetFile("a_dir", file)
+		if err != nil {
+			t.Fatal("Unexpected error: ", err)
+		}
+	}
+	err = client.GC()
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	for _, file := range []string{"a_dir/pkg.lock", "a_dir/pkg.part"} {
+		_, err = os.Stat(path.Join(client.localCache, file))
+		if err != nil {
+			t.Fatal("File shouldn't have been removed: ", err)
+		}
+	}
+
+	// The reserved directory can't be requested, even if a server published it
+	_, err = client.GetFile(types.ReservedDir, locksDir, cacheFileID("a_dir/pkg.lock"))
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatal("Expected ErrNotFound, got ", err)
+	}
+}
+
+func TestCacheEviction(t *testing.T) {
+	client, server, err := InitTestClient()
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	defer server.Shutdown(nil)
+
+	err = addTestFiles(client, "b_dir/one", "b_dir/two")
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	client.SetMaxCacheSize(600)
+	client.accessResolution = 0
+	for _, file := range [][]string{{"a_dir", "testfile"}, {"b_dir", "one"}, {"a_dir", "testfile"}, {"b_dir", "two"}} {
+		_, err = client.GetFile(file...)
+		if err != nil {
+			t.Fatal("Unexpected error: ", err)
+		}
+	}
+
+	for file, expected := range map[string]bool{"a_dir/testfile": true, "b_dir/one": false, "b_dir/two": true} {
+		_, err = os.Stat(path.Join(client.localCache, file))
+		if (err == nil) != expected {
+			t.Fatal("Unexpected cache state for ", file, ": ", err)
+		}
+	}
+}
+
+func TestCacheEvictionLocked(t *testing.T) {
+	client, server, err := InitTestClient()
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	defer server.Shutdown(nil)
+
+	err = addTestFiles(client, "b_dir/one")
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	client.SetMaxCacheSize(300)
+	_, err = client.GetFile("a_dir", "testfile")
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+
+	// The least recently used file is in use by someone else, so it is kept
+	lockFile, err := client.internalFile(locksDir, cacheFileID("a_dir/testfile"))
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	lock, err := lockPath(lockFile)
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	_, err = client.GetFile("b_dir", "one")
+	lock.Close()
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	_, err = os.Stat(path.Join(client.localCache, "a_dir", "testfile"))
+	if err != nil {
+		t.Fatal("Locked file shouldn't have been evicted: ", err)
+	}
+
+	// Once it isn't in use anymore, it is evicted together with its lock file
+	err = client.updateState(func(state *clientState) error {
+		return client.evict(state, "b_dir/one")
+	})
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	for _, file := range []string{path.Join(client.localCache, "a_dir", "testfile"), lockFile} {
+		_, err = os.Stat(file)
+		if !os.IsNotExist(err) {
+			t.Fatal("File should have been evicted: ", file)
+		}
+	}
+}
+
+func TestCacheHitWithoutEviction(t *testing.T) {
+	client, server, err := InitTestClient()
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	defer server.Shutdown(nil)
+
+	_, err = client.GetFile("a_dir", "testfile")
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	stateFile := path.Join(client.localCache, "state.yml")
+	oldState, err := ioutil.ReadFile(stateFile)
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+
+	// Without a maximum cache size, access times aren't needed, so cache hits shouldn't write the state
+	_, err = client.GetFile("a_dir", "testfile")
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	newState, err := ioutil.ReadFile(stateFile)
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	if !bytes.Equal(oldState, newState) {
+		t.Fatal("State shouldn't have been written")
+	}
+}
+
+func TestFileDownloadContext(t *testing.T) {
+	client, server, err := InitTestClient()
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	defer server.Shutdown(nil)
+
+	// Provide a mirror that never answers
+	done := make(chan struct{})
+	defer close(done)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	})
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	hangingServer := &http.Server{
+		Handler: mux,
+	}
+	go hangingServer.Serve(listener)
+	defer hangingServer.Close()
+	client.mirrors = []*mirror{{url: "http://" + listener.Addr().String()}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	filePath, err := client.GetFileContext(ctx, "a_dir", "testfile")
+	if err == nil {
+		t.Fatal("Expected error missing")
+	} else if !strings.HasSuffix(err.Error(), context.DeadlineExceeded.Error()) {
+		t.Fatal("Unxpected error: ", err)
+	}
+	if filePath != "" {
+		t.Fatal("Unexpectedly got a path?")
+	}
+}
+
+func TestFileDownloadTypedErrors(t *testing.T) {
+	client, server, err := InitTestClient()
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	defer server.Shutdown(nil)
+	repoFile := path.Join(path.Dir(client.localCache), "repo", "a_dir", "testfile")
+
+	// Same size, different content
+	err = ioutil.WriteFile(repoFile, make([]byte, 256), 0600)
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	_, err = client.GetFile("a_dir", "testfile")
+	if !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatal("Unexpected error: ", err)
+	}
+
+	err = os.Remove(repoFile)
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	_, err = client.GetFile("a_dir", "testfile")
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatal("Unexpected error: ", err)
+	}
+	var statusErr *HTTPStatusError
+	if !errors.As(err, &statusErr) || statusErr.Code != http.StatusNotFound {
+		t.Fatal("Unexpected error: ", err)
+	}
+
+	client.meta = nil
+	_, err = client.GetFile("a_dir", "testfile")
+	if err != ErrNoMetadata {
+		t.Fatal("Unexpected error: ", err)
+	}
+}
+
+func TestIsTemporary(t *testing.T) {
+	for _, test := range []struct {
+		err       error
+		temporary bool
+	}{
+		{&HTTPStatusError{Code: http.StatusServiceUnavailable}, true},
+		{&HTTPStatusError{Code: http.StatusNotFound}, false},
+		{&url.Error{Op: "Get", Err: &net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}}, true},
+		{&url.Error{Op: "Get", Err: context.DeadlineExceeded}, true},
+		{fmt.Errorf("file download failed: %w", syscall.ECONNRESET), true},
+		{fmt.Errorf("file download failed: %w", io.ErrUnexpectedEOF), true},
+		{&url.Error{Op: "Get", Err: x509.UnknownAuthorityError{}}, false},
+		{&url.Error{Op: "Get", Err: errors.New("unsupported protocol scheme")}, false},
+		{ErrChecksumMismatch, false},
+	} {
+		if isTemporary(test.err) != test.temporary {
+			t.Error("Unexpected result for ", test.err)
+		}
+	}
+}
+
+func TestFileDownloadResume(t *testing.T) {
+	client, server, err := InitTestClient()
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	defer server.Shutdown(nil)
+
+	// Provide a mirror that fails with 503 first, then drops the connection after 100 bytes
+	repoRoot := path.Join(path.Dir(client.localCache), "repo")
+	fileServer := http.FileServer(http.Dir(repoRoot))
+	var ranges []string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		switch len(ranges) {
+		case 1:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case 2:
+			content, _ := ioutil.ReadFile(path.Join(repoRoot, r.URL.Path))
+			w.Header().Set("Content-Length", "256")
+			w.Write(content[:100])
+		default:
+			fileServer.ServeHTTP(w, r)
+		}
+	})
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	flakyServer := &http.Server{
+		Handler: mux,
+	}
+	go flakyServer.Serve(listener)
+	defer flakyServer.Close()
+	client.mirrors = []*mirror{{url: "http://" + listener.Addr().String()}}
+
+	client.retryPolicy = RetryPolicy{
+		MaxAttempts:  3,
+		InitialDelay: time.Millisecond,
+		Jitter:       0.5,
+	}
+	filePath, err := client.GetFile("a_dir", "testfile")
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	if len(ranges) != 3 || ranges[0] != "" || ranges[1] != "" || ranges[2] != "bytes=100-" {
+		t.Fatal("Unexpected requests: ", ranges)
+	}
+	content, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	original, err := ioutil.ReadFile(path.Join(repoRoot, "a_dir", "testfile"))
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	if !bytes.Equal(content, original) {
+		t.Fatal("Resumed download is broken")
+	}
+}
+
+func TestFileDownloadResumeStale(t *testing.T) {
+	client, server, err := InitTestClient()
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	defer server.Shutdown(nil)
+
+	// Leave a partial file which doesn't belong to the current version
+	partFile, err := client.internalFile(partialDir, cacheFileID("a_dir/testfile"))
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	err = ioutil.WriteFile(partFile, make([]byte, 100), 0600)
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+
+	_, err = client.GetFile("a_dir", "testfile")
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	_, err = os.Stat(partFile)
+	if !os.IsNotExist(err) {
+		t.Fatal("Partial file wasn't removed: ", err)
+	}
+}
+
+func TestMirrorFailover(t *testing.T) {
+	client, server, err := InitTestClient()
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	defer server.Shutdown(nil)
+
+	// Provide a mirror that serves garbage
+	requests := 0
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write(make([]byte, 256))
+	})
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	brokenServer := &http.Server{
+		Handler: mux,
+	}
+	go brokenServer.Serve(listener)
+	defer brokenServer.Close()
+	goodMirror := client.mirrors[0]
+	client.mirrors = []*mirror{{url: "http://" + listener.Addr().String()}, goodMirror}
+
+	err = forgetValidators(client)
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	fresh, err := client.TryUpdate()
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	if fresh != Updated {
+		t.Fatal("Metadata should have been fetched from second mirror")
+	}
+	if requests != 2 {
+		t.Fatal("Unexpected number of requests to broken mirror: ", requests)
+	}
+
+	// Broken mirror should be skipped now
+	_, err = client.GetFile("a_dir", "testfile")
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	if requests != 2 {
+		t.Fatal("Broken mirror should have been skipped")
+	}
+
+	// After the cooldown, the mirror should be tried again, fail due to the checksum and be skipped
+	client.mirrors[0].failedUntil = time.Time{}
+	_, _, err = client.GetFileLatest("a_dir", "testfile")
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	if requests != 3 {
+		t.Fatal("Unexpected number of requests to broken mirror: ", requests)
+	}
+	if !client.mirrors[0].failedUntil.After(time.Now()) {
+		t.Fatal("Broken mirror should be in cooldown")
+	}
+}
+
+func TestTryUpdateConditional(t *testing.T) {
+	client, server, err := InitTestClient()
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	defer server.Shutdown(nil)
+
+	// Last-Modified has a resolution of one second, so it can't be used when the metadata is fetched in the same
+	// second it was created in. Fetch unconditionally, as the first fetch might have been late enough to use it.
+	time.Sleep(time.Second)
+	result, err := client.fetchMeta(context.Background(), false)
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	if result != Updated {
+		t.Fatal("Metadata should have been updated: ", result)
+	}
+	// The local copy is loaded already, so it shouldn't be read again if it is unchanged
+	err = ioutil.WriteFile(path.Join(client.localCache, "meta.asc"), []byte("garbage"), 0600)
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	result, err = client.TryUpdate()
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	if result != Unchanged {
+		t.Fatal("Metadata should have been unchanged: ", result)
+	}
+
+	oldMeta := client.currentMeta()
+	err = updateTestAssets(client, 0)
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	result, err = client.TryUpdate()
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	if result != Updated {
+		t.Fatal("Metadata should have been updated: ", result)
+	}
+	if !client.currentMeta().Timestamp.After(oldMeta.Timestamp) {
+		t.Fatal("Updated metadata wasn't loaded")
+	}
+}
+
+func TestWatch(t *testing.T) {
+	client, server, err := InitTestClient()
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	defer server.Shutdown(nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	events := client.Watch(ctx, 50*time.Millisecond)
+
+	repoRoot := path.Join(path.Dir(client.localCache), "repo")
+	err = ioutil.WriteFile(path.Join(repoRoot, "a_dir", "testfile"), []byte("changed"), 0600)
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	err = os.MkdirAll(path.Join(repoRoot, "b_dir"), 0700)
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	err = ioutil.WriteFile(path.Join(repoRoot, "b_dir", "new"), []byte("new"), 0600)
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	err = updateTestAssets(client, 0)
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+
+	select {
+	case event := <-events:
+		if len(event.Added) != 1 || event.Added[0] != "b_dir/new" {
+			t.Fatal("Unexpected added files: ", event.Added)
+		}
+		if len(event.Changed) != 1 || event.Changed[0] != "a_dir/testfile" {
+			t.Fatal("Unexpected changed files: ", event.Changed)
+		}
+		if len(event.Removed) != 0 {
+			t.Fatal("Unexpected removed files: ", event.Removed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("No event received")
+	}
+
+	cancel()
+	for range events {
+		// Drain until closed
+	}
+}
+
+func TestWatchSharedCache(t *testing.T) {
+	client, server, err := InitTestClient()
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	defer server.Shutdown(nil)
+
+	// Another client sharing the cache fetches the new metadata first, so the watching client gets 304 Not Modified
+	pubkeyBin, err := ioutil.ReadFile(path.Join(path.Dir(client.localCache), "pub.asc"))
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	otherClient := NewRepoClient(client.localCache, client.mirrors[0].url, string(pubkeyBin))
+	repoRoot := path.Join(path.Dir(client.localCache), "repo")
+	err = ioutil.WriteFile(path.Join(repoRoot, "a_dir", "new"), []byte("new"), 0600)
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	err = updateTestAssets(client, 0)
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	// Last-Modified can only be used as a validator once the second the metadata was created in has passed
+	time.Sleep(time.Second)
+	_, err = otherClient.TryUpdate()
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	events := client.Watch(ctx, 50*time.Millisecond)
+	select {
+	case event := <-events:
+		if len(event.Added) != 1 || event.Added[0] != "a_dir/new" {
+			t.Fatal("Unexpected added files: ", event.Added)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("No event received")
+	}
+
+	cancel()
+	for range events {
+		// Drain until closed
+	}
+}
+
+func TestWatchInvalidInterval(t *testing.T) {
+	client, server, err := InitTestClient()
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	defer server.Shutdown(nil)
+	transport := &countingTransport{
+		requests: make(map[string]int),
+	}
+	defer transport.transport.CloseIdleConnections()
+	client.SetTransport(transport)
+
+	// An interval of 0 must not refresh the metadata continuously
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	client.WatchFunc(ctx, 0, func(event ChangeEvent) {})
+	if transport.requests["/meta.yml"] != 0 {
+		t.Fatal("Unexpected number of refreshes: ", transport.requests["/meta.yml"])
+	}
+}
+
+// countingTransport counts the requests for each path
+type countingTransport struct {
+	lock      sync.Mutex
+	requests  map[string]int
+	transport http.Transport
+}
+
+func (c *countingTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	c.lock.Lock()
+	c.requests[request.URL.Path]++
+	c.lock.Unlock()
+	return c.transport.RoundTrip(request)
+}
+
+func TestConcurrentAccess(t *testing.T) {
+	client, server, err := InitTestClient()
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	defer server.Shutdown(nil)
+
+	// A second client sharing the cache acts like another process
+	pubkeyBin, err := ioutil.ReadFile(path.Join(path.Dir(client.localCache), "pub.asc"))
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	otherClient := NewRepoClient(client.localCache, client.mirrors[0].url, string(pubkeyBin))
+	_, err = otherClient.TryUpdate()
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	transport := &countingTransport{
+		requests: make(map[string]int),
+		transport: http.Transport{
+			// Avoid connections which are dialed but never used, shutting down the server would wait for them
+			MaxConnsPerHost: 1,
+		},
+	}
+	defer transport.transport.CloseIdleConnections()
+	client.SetTransport(transport)
+	otherClient.SetTransport(transport)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := 0; i < 8; i++ {
+		for _, item := range []*Minirepo{client, otherClient} {
+			wg.Add(1)
+			go func(item *Minirepo) {
+				defer wg.Done()
+				_, err := item.GetFile("a_dir", "testfile")
+				errs <- err
+			}(item)
+		}
+	}
+	for _, item := range []*Minirepo{client, otherClient} {
+		wg.Add(1)
+		go func(item *Minirepo) {
+			defer wg.Done()
+			_, err := item.TryUpdate()
+			errs <- err
+		}(item)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Fatal("Unexpected error: ", err)
+		}
+	}
+	if transport.requests["/a_dir/testfile"] != 1 {
+		t.Fatal("Expected a single download, got ", transport.requests["/a_dir/testfile"])
+	}
+}
+
+func TestConcurrentAccessContext(t *testing.T) {
+	client, server, err := InitTestClient()
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	defer server.Shutdown(nil)
+
+	// Provide a mirror that only answers once released
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	fileServer := http.FileServer(http.Dir(path.Join(path.Dir(client.localCache), "repo")))
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case started <- struct{}{}:
+		default:
+		}
+		<-release
+		fileServer.ServeHTTP(w, r)
+	})
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	slowServer := &http.Server{
+		Handler: mux,
+	}
+	go slowServer.Serve(listener)
+	defer slowServer.Close()
+	client.mirrors = []*mirror{{url: "http://" + listener.Addr().String()}}
+
+	// The first caller gives up, which mustn't affect the second one sharing its download
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	firstErr := make(chan error, 1)
+	go func() {
+		_, err := client.GetFileContext(ctx, "a_dir", "testfile")
+		firstErr <- err
+	}()
+	<-started
+	secondErr := make(chan error, 1)
+	go func() {
+		_, err := client.GetFile("a_dir", "testfile")
+		secondErr <- err
+	}()
+	for waiters := 0; waiters < 2; time.Sleep(time.Millisecond) {
+		client.downloads.lock.Lock()
+		for _, call := range client.downloads.calls {
+			waiters = call.waiters
+		}
+		client.downloads.lock.Unlock()
+	}
+
+	// A caller with a short deadline returns without waiting for the download
+	shortCtx, shortCancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer shortCancel()
+	_, err = client.GetFileContext(shortCtx, "a_dir", "testfile")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatal("Unexpected error: ", err)
+	}
+
+	cancel()
+	err = <-firstErr
+	if !errors.Is(err, context.Canceled) {
+		t.Fatal("Unexpected error: ", err)
+	}
+	close(release)
+	err = <-secondErr
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+}
+
+func TestList(t *testing.T) {
+	client, server, err := InitTestClient()
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	defer server.Shutdown(nil)
+
+	err = addTestFiles(client, "b_dir/one", "b_dir/sub/two")
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+
+	root, err := client.List()
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	if len(root) != 2 || root[0].Name() != "a_dir" || root[1].Name() != "b_dir" || !root[0].IsDir() {
+		t.Fatal("Unexpected root listing: ", root)
+	}
+	children, err := client.List("b_dir")
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	if len(children) != 2 || strings.Join(children[0].Path, "/") != "b_dir/one" || children[0].IsDir() ||
+		children[0].Size != 256 || !children[1].IsDir() {
+		t.Fatal("Unexpected listing: ", children)
+	}
+	_, err = client.List("b_dir", "one")
+	if err != ErrNotDirectory {
+		t.Fatal("Expected ErrNotDirectory, got ", err)
+	}
+	_, err = client.List("c_dir")
+	if err != ErrNotFound {
+		t.Fatal("Expected ErrNotFound, got ", err)
+	}
+
+	var walked []string
+	err = client.Walk(func(info FileInfo) error {
+		walked = append(walked, strings.Join(info.Path, "/"))
+		if info.Name() == "sub" {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	if strings.Join(walked, ",") != "a_dir,a_dir/testfile,b_dir,b_dir/one,b_dir/sub" {
+		t.Fatal("Unexpected walk: ", walked)
+	}
+
+	matches, err := client.Glob("*/t*")
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	if len(matches) != 1 || strings.Join(matches[0].Path, "/") != "a_dir/testfile" {
+		t.Fatal("Unexpected matches: ", matches)
+	}
+	matches, err = client.Glob("b_dir/*/two")
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	if len(matches) != 1 || strings.Join(matches[0].Path, "/") != "b_dir/sub/two" {
+		t.Fatal("Unexpected matches: ", matches)
+	}
+	_, err = client.Glob("b_dir/[")
+	if err != path.ErrBadPattern {
+		t.Fatal("Expected ErrBadPattern, got ", err)
+	}
+}
+
+func TestGetLatest(t *testing.T) {
+	client, server, err := InitTestClient()
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	defer server.Shutdown(nil)
+
+	err = addTestFiles(client, "linux/tool/1.2.0/bin", "linux/tool/1.10.1/bin", "linux/tool/v2.0.0/bin",
+		"linux/tool/2.1.0-rc.1/bin", "linux/tool/nightly/bin")
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+
+	for constraint, expected := range map[string]string{"^1.2": "1.10.1", "~1.2": "1.2.0", "": "v2.0.0",
+		">=2.0 <3": "v2.0.0", ">=2.1.0-rc.1": "2.1.0-rc.1"} {
+		version, err := client.LatestVersion("linux", "tool", constraint)
+		if err != nil {
+			t.Fatal("Unexpected error: ", err)
+		}
+		if version.String() != expected {
+			t.Fatal("Unexpected version for ", constraint, ": ", version)
+		}
+	}
+
+	fileRef, err := client.GetLatest("linux", "tool", "^1.2", "bin")
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	if fileRef != path.Join(client.localCache, "linux", "tool", "1.10.1", "bin") {
+		t.Fatal("Unexpected file: ", fileRef)
+	}
+	_, err = client.GetLatest("linux", "tool", "^3", "bin")
+	if !errors.Is(err, ErrNoMatchingVersion) {
+		t.Fatal("Expected ErrNoMatchingVersion, got ", err)
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	client, httpServer, err := InitTestClient()
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	defer httpServer.Shutdown(nil)
+
+	testPath := path.Dir(client.localCache)
+	oldPubkey, err := ioutil.ReadFile(path.Join(testPath, "pub.asc"))
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	svc := server.NewServer(testPath, path.Join(testPath, "repo"), "Unittest Server")
+	svc.SetKeyAlgorithm(server.KeyECDSAP256)
+	err = svc.LoadKeypair()
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	err = svc.StartKeyRotation()
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	_, err = svc.UpdateMetadata()
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	result, err := client.TryUpdate()
+	if err != nil || result != Updated {
+		t.Fatal("Unexpected result: ", result, err)
+	}
+
+	err = svc.FinishKeyRotation()
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	_, err = svc.UpdateMetadata()
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	// The client adopted the new key during the rotation
+	result, err = client.TryUpdate()
+	if err != nil || result != Updated {
+		t.Fatal("Unexpected result: ", result, err)
+	}
+	_, err = client.GetFile("a_dir", "testfile")
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	// A client which missed the rotation doesn't know the new key
+	otherCache := path.Join(testPath, "other")
+	os.Mkdir(otherCache, 0700)
+	otherClient := NewRepoClient(otherCache, client.mirrors[0].url, string(oldPubkey))
+	_, err = otherClient.TryUpdate()
+	if !errors.Is(err, ErrSignatureInvalid) {
+		t.Fatal("Expected ErrSignatureInvalid, got ", err)
+	}
+
+	// The client retired the old key once the metadata was signed by the new key only
+	oldRoot := path.Join(testPath, "old")
+	os.Mkdir(oldRoot, 0700)
+	for _, rename := range [][2]string{{"old-pub.asc", "pub.asc"}, {"old-priv.asc", "priv.asc"}} {
+		err = os.Rename(path.Join(testPath, rename[0]), path.Join(oldRoot, rename[1]))
+		if err != nil {
+			t.Fatal("Unexpected error: ", err)
+		}
+	}
+	oldSvc := server.NewServer(oldRoot, path.Join(testPath, "repo"), "Unittest Server")
+	err = oldSvc.LoadKeypair()
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	_, err = oldSvc.UpdateMetadata()
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	_, err = client.fetchMeta(context.Background(), false)
+	if !errors.Is(err, ErrSignatureInvalid) {
+		t.Fatal("Expected ErrSignatureInvalid, got ", err)
+	}
+}
+
+func TestSignatureThreshold(t *testing.T) {
+	client, httpServer, err := InitTestClient()
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	defer httpServer.Shutdown(nil)
+
+	testPath := path.Dir(client.localCache)
+	coRoot := path.Join(testPath, "cosigner")
+	os.Mkdir(coRoot, 0700)
+	coSigner := server.NewServer(coRoot, path.Join(testPath, "repo"), "Co-Signer")
+	// The co-signer uses ECDSA, so verification of both algorithms is covered
+	coSigner.SetKeyAlgorithm(server.KeyECDSAP384)
+	err = coSigner.GenerateKeypair()
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	err = coSigner.LoadKeypair()
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	coPubkey, err := ioutil.ReadFile(path.Join(coRoot, "pub.asc"))
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	client.signingKeys = append(client.signingKeys, string(coPubkey))
+	client.SetSignatureThreshold(2)
+
+	// Only signed by the original key so far
+	err = updateTestAssets(client, 0)
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	_, err = client.fetchMeta(context.Background(), false)
+	if !errors.Is(err, ErrSignatureInvalid) {
+		t.Fatal("Expected ErrSignatureInvalid, got ", err)
+	}
+
+	err = coSigner.AddSignature()
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	result, err := client.TryUpdate()
+	if err != nil || result != Updated {
+		t.Fatal("Unexpected result: ", result, err)
+	}
+
+	client.SetSignatureThreshold(3)
+	_, err = client.TryUpdate()
+	if !errors.Is(err, ErrSignatureInvalid) {
+		t.Fatal("Expected ErrSignatureInvalid, got ", err)
+	}
+}
+
+func TestSignatureThresholdKeyRotation(t *testing.T) {
+	client, httpServer, err := InitTestClient()
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	defer httpServer.Shutdown(nil)
+
+	testPath := path.Dir(client.localCache)
+	coRoot := path.Join(testPath, "cosigner")
+	os.Mkdir(coRoot, 0700)
+	coSigner := server.NewServer(coRoot, path.Join(testPath, "repo"), "Co-Signer")
+	coSigner.SetKeyAlgorithm(server.KeyECDSAP256)
+	err = coSigner.GenerateKeypair()
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	err = coSigner.LoadKeypair()
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	coPubkey, err := ioutil.ReadFile(path.Join(coRoot, "pub.asc"))
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	client.signingKeys = append(client.signingKeys, string(coPubkey))
+	client.SetSignatureThreshold(2)
+
+	// The client adopts the new key, as the announcement is co-signed
+	svc := server.NewServer(testPath, path.Join(testPath, "repo"), "Unittest Server")
+	svc.SetKeyAlgorithm(server.KeyECDSAP256)
+	err = svc.LoadKeypair()
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	err = svc.StartKeyRotation()
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	_, err = svc.UpdateMetadata()
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	err = coSigner.AddSignature()
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	result, err := client.TryUpdate()
+	if err != nil || result != Updated {
+		t.Fatal("Unexpected result: ", result, err)
+	}
+
+	// Signatures by the old and the new key of the same signer only count once
+	_, err = svc.UpdateMetadata()
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	_, err = client.fetchMeta(context.Background(), false)
+	if !errors.Is(err, ErrSignatureInvalid) {
+		t.Fatal("Expected ErrSignatureInvalid, got ", err)
+	}
+}
@@ -0,0 +1,236 @@
+/*
+ * Copyright 2018 The minirepo authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minirepo
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"github.com/uubk/minirepo/pkg/minirepo/types"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// isTemporary decides whether a request failing with 'err' should be retried. This is the case for timeouts, failed
+// connections, interrupted transfers and server-side HTTP errors, but not for e.g. TLS certificate errors.
+func isTemporary(err error) bool {
+	var statusErr *HTTPStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.Temporary()
+	}
+	// Every error of http.Client is a net.Error, so only its timeout flag says something about the cause
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// retry calls 'attempt' until it succeeds, fails permanently or the retry policy is exhausted
+func (m *Minirepo) retry(ctx context.Context, url string, attempt func() error) error {
+	for i := 1; ; i++ {
+		err := attempt()
+		if err == nil || !isTemporary(err) || i >= m.retryPolicy.MaxAttempts || ctx.Err() != nil {
+			return err
+		}
+		delay := m.retryPolicy.delay(i)
+		m.logger.WithError(err).WithFields(log.Fields{
+			"url":   url,
+			"delay": delay,
+		}).Debug("Request failed, retrying")
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// get issues a GET request for 'url' with additional headers 'header' using the configured HTTP client. Responses with
+// a status other than 2xx are returned as HTTPStatusError.
+func (m *Minirepo) get(ctx context.Context, url string, header http.Header) (*http.Response, error) {
+	request, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range header {
+		request.Header[key] = values
+	}
+	if m.userAgent != "" {
+		request.Header.Set("User-Agent", m.userAgent)
+	}
+
+	response, err := m.httpClient.Do(request.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		response.Body.Close()
+		return nil, &HTTPStatusError{URL: url, Code: response.StatusCode}
+	}
+	return response, nil
+}
+
+// fetchAll downloads 'url' with additional headers 'header' into memory, retrying according to the retry policy. This
+// is only meant for small files like the metadata. Returns the content and the response headers.
+func (m *Minirepo) fetchAll(ctx context.Context, url string, header http.Header) ([]byte, http.Header, error) {
+	var content []byte
+	var responseHeader http.Header
+	err := m.retry(ctx, url, func() error {
+		response, err := m.get(ctx, url, header)
+		if err != nil {
+			return err
+		}
+		defer response.Body.Close()
+		responseHeader = response.Header
+		content, err = ioutil.ReadAll(response.Body)
+		return err
+	})
+	return content, responseHeader, err
+}
+
+// download fetches 'fileUrl' into the partial file 'fd' and verifies it against 'entry'. If 'fd' already contains data
+// from an interrupted download, only the remainder is requested.
+func (m *Minirepo) download(ctx context.Context, fileUrl string, fd *os.File, entry *types.DirEntry) error {
+	_, err := fd.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	hash := sha256.New()
+	offset, err := io.Copy(hash, fd)
+	if err != nil {
+		return err
+	}
+	if offset > 0 {
+		// If the partial file turns out to be broken (e.g. because it belongs to an older version of the file), start
+		// over once
+		err = m.resume(ctx, fileUrl, fd, hash, offset, entry)
+		if err == nil || isTemporary(err) || ctx.Err() != nil {
+			return err
+		}
+		m.logger.WithError(err).WithField("url", fileUrl).Debug("Resumed download failed, starting over")
+		err = fd.Truncate(0)
+		if err != nil {
+			return err
+		}
+		hash.Reset()
+		offset = 0
+	}
+	return m.resume(ctx, fileUrl, fd, hash, offset, entry)
+}
+
+// resume downloads 'fileUrl' starting at 'offset' into 'fd'. 'fd' and 'hash' already contain the first 'offset' bytes
+// of the file.
+func (m *Minirepo) resume(ctx context.Context, fileUrl string, fd *os.File, hash hash.Hash, offset int64,
+	entry *types.DirEntry) error {
+	if offset > 0 && entry.Size != nil && offset >= *entry.Size {
+		// Nothing left to download
+		return m.storeFile(fd, hash, offset, entry, strings.NewReader(""))
+	}
+
+	header := http.Header{}
+	if offset > 0 {
+		header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	response, err := m.get(ctx, fileUrl, header)
+	if err != nil {
+		return fmt.Errorf("file download failed: %w", err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode == http.StatusPartialContent {
+		if offset == 0 || !strings.HasPrefix(response.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", offset)) {
+			return fmt.Errorf("file download failed: unexpected range %s", response.Header.Get("Content-Range"))
+		}
+		m.logger.WithFields(log.Fields{
+			"url":    fileUrl,
+			"offset": offset,
+		}).Debug("Resuming download")
+	} else if offset > 0 {
+		// Server ignored the range and sent the whole file
+		offset = 0
+		hash.Reset()
+		err = fd.Truncate(0)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = fd.Seek(offset, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	if response.ContentLength >= 0 {
+		if entry.Size != nil && offset+response.ContentLength > *entry.Size {
+			return fmt.Errorf("%w: announced %d bytes, got %d", ErrSizeMismatch, *entry.Size,
+				offset+response.ContentLength)
+		}
+		if m.maxFileSize > 0 && offset+response.ContentLength > m.maxFileSize {
+			return ErrFileTooLarge
+		}
+	}
+	return m.storeFile(fd, hash, offset, entry, response.Body)
+}
+
+// storeFile streams 'body' into 'fd' while hashing it and checks the result against the size and hash from 'entry'.
+// 'fd' and 'hash' already contain the first 'offset' bytes of the file. The caller is responsible for discarding the
+// file if a non-temporary error is returned.
+func (m *Minirepo) storeFile(fd io.Writer, hash hash.Hash, offset int64, entry *types.DirEntry, body io.Reader) error {
+	// A limit of -1 means unlimited, as empty files need to be limited to 0 bytes
+	limit := int64(-1)
+	if m.maxFileSize > 0 {
+		limit = m.maxFileSize
+	}
+	if entry.Size != nil && (limit < 0 || *entry.Size < limit) {
+		limit = *entry.Size
+	}
+	if limit >= 0 {
+		// Read one byte more than allowed so that oversized bodies can be detected
+		body = io.LimitReader(body, limit-offset+1)
+	}
+	written, err := io.Copy(io.MultiWriter(fd, hash), body)
+	written += offset
+	if err != nil {
+		return fmt.Errorf("file download failed: %w", err)
+	}
+	if entry.Size != nil && written > *entry.Size {
+		return fmt.Errorf("%w: announced %d bytes, got more", ErrSizeMismatch, *entry.Size)
+	}
+	if m.maxFileSize > 0 && written > m.maxFileSize {
+		return ErrFileTooLarge
+	}
+	if entry.Size != nil && written != *entry.Size {
+		return fmt.Errorf("%w: announced %d bytes, got %d", ErrSizeMismatch, *entry.Size, written)
+	}
+
+	hashSum := hex.EncodeToString(hash.Sum(nil))
+	if hashSum != entry.Hash || hashSum == "" {
+		return ErrChecksumMismatch
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+/*
+ * Copyright 2018 The minirepo authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minirepo
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+var (
+	// ErrNotFound is returned if a file isn't part of the metadata. HTTPStatusErrors for status 404 match it as well.
+	ErrNotFound = errors.New("file not found")
+	// ErrNoMetadata is returned if files are requested before any metadata was loaded
+	ErrNoMetadata = errors.New("no metadata available")
+	// ErrNotDirectory is returned if a directory listing is requested for a file
+	ErrNotDirectory = errors.New("not a directory")
+	// ErrNoMatchingVersion is returned if no version satisfies a version constraint
+	ErrNoMatchingVersion = errors.New("no matching version")
+	// ErrChecksumMismatch is returned if the hash of a downloaded file doesn't match the metadata
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+	// ErrSizeMismatch is returned if the size of a downloaded file doesn't match the metadata
+	ErrSizeMismatch = errors.New("file size doesn't match metadata")
+	// ErrFileTooLarge is returned if a download exceeds the maximum file size
+	ErrFileTooLarge = errors.New("file exceeds maximum size")
+	// ErrSignatureInvalid is returned if the metadata signature couldn't be verified
+	ErrSignatureInvalid = errors.New("signature invalid or check failed")
+	// ErrRollback is returned if the metadata is older than metadata accepted before
+	ErrRollback = errors.New("metadata rollback detected")
+	// ErrMetadataExpired is returned if the metadata passed its expiry date
+	ErrMetadataExpired = errors.New("metadata expired")
+)
+
+// HTTPStatusError is returned if the repository answered a request with an unexpected status code
+type HTTPStatusError struct {
+	// Requested URL
+	URL string
+	// HTTP status code
+	Code int
+}
+
+func (e *HTTPStatusError) Error() string {
+	return fmt.Sprintf("unexpected HTTP status %d (%s) for %s", e.Code, http.StatusText(e.Code), e.URL)
+}
+
+// Is allows matching errors for status 404 against ErrNotFound
+func (e *HTTPStatusError) Is(target error) bool {
+	return target == ErrNotFound && e.Code == http.StatusNotFound
+}
+
+// Temporary returns whether the status indicates a server-side problem, which may go away when retrying later
+func (e *HTTPStatusError) Temporary() bool {
+	return e.Code >= 500
+}
@@ -0,0 +1,96 @@
+/*
+ * Copyright 2018 The minirepo authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minirepo
+
+import (
+	"context"
+	"sync"
+)
+
+// flightCall is a download in progress
+type flightCall struct {
+	// Closed once the download finished
+	done chan struct{}
+	// Result of the download
+	fileRef string
+	err     error
+	// Number of callers waiting for the result
+	waiters int
+	// Aborts the download, which happens once no caller waits for it anymore
+	cancel context.CancelFunc
+	// Whether the download was aborted
+	aborted bool
+}
+
+// flightGroup deduplicates concurrent downloads of the same file. The zero value is ready to use.
+type flightGroup struct {
+	lock  sync.Mutex
+	calls map[string]*flightCall
+}
+
+// do calls 'fn' unless a call for 'key' is already in progress, in which case it waits for that call and returns its
+// result instead. 'fn' gets a context of its own, which is canceled once all callers waiting for the result are done.
+// If 'ctx' is done first, ctx.Err() is returned without waiting for the result.
+func (g *flightGroup) do(ctx context.Context, key string, fn func(context.Context) (string, error)) (string, error) {
+	for {
+		g.lock.Lock()
+		if g.calls == nil {
+			g.calls = make(map[string]*flightCall)
+		}
+		call, ok := g.calls[key]
+		if !ok {
+			callCtx, cancel := context.WithCancel(context.Background())
+			call = &flightCall{
+				done:   make(chan struct{}),
+				cancel: cancel,
+			}
+			g.calls[key] = call
+			go g.run(callCtx, key, call, fn)
+		}
+		call.waiters++
+		g.lock.Unlock()
+
+		select {
+		case <-call.done:
+			if call.aborted && ctx.Err() == nil {
+				// All other callers gave up just before we joined, so start over
+				continue
+			}
+			return call.fileRef, call.err
+		case <-ctx.Done():
+			g.lock.Lock()
+			call.waiters--
+			if call.waiters == 0 {
+				call.cancel()
+			}
+			g.lock.Unlock()
+			return "", ctx.Err()
+		}
+	}
+}
+
+// run calls 'fn' for 'call' and publishes the result
+func (g *flightGroup) run(ctx context.Context, key string, call *flightCall, fn func(context.Context) (string, error)) {
+	call.fileRef, call.err = fn(ctx)
+	call.aborted = ctx.Err() != nil
+	call.cancel()
+
+	g.lock.Lock()
+	delete(g.calls, key)
+	g.lock.Unlock()
+	close(call.done)
+}
@@ -0,0 +1,94 @@
+/*
+ * Copyright 2018 The minirepo authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minirepo
+
+import (
+	"os"
+	"path"
+)
+
+// lockFileName is the file in the root of the cache directory used to synchronize processes sharing the cache
+const lockFileName = "cache.lock"
+
+// withCacheLock calls 'fn' while holding an exclusive lock on the cache directory. The lock is shared between all
+// goroutines and processes using the same cache directory, so 'fn' may safely modify the state and the metadata.
+func (m *Minirepo) withCacheLock(fn func() error) error {
+	fd, err := lockPath(path.Join(m.localCache, lockFileName))
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	return fn()
+}
+
+// updateState loads the client state, passes it to 'fn' and saves it afterwards if 'fn' succeeded. This happens while
+// holding the cache lock, so concurrent updates don't get lost.
+func (m *Minirepo) updateState(fn func(state *clientState) error) error {
+	return m.withCacheLock(func() error {
+		state, err := m.loadState()
+		if err != nil {
+			return err
+		}
+		err = fn(state)
+		if err != nil {
+			return err
+		}
+		return m.saveState(state)
+	})
+}
+
+// lockPath opens 'file', creating it if necessary, and blocks until it acquired an exclusive lock on it. The lock is
+// released by closing the returned file. If the file was removed or replaced while waiting for the lock, the new file
+// is locked instead.
+func lockPath(file string) (*os.File, error) {
+	return acquirePath(file, true)
+}
+
+// tryLockPath is like lockPath, but returns nil instead of blocking if the lock is held by someone else
+func tryLockPath(file string) (*os.File, error) {
+	return acquirePath(file, false)
+}
+
+// acquirePath implements lockPath and tryLockPath, 'wait' decides whether to block until the lock is available
+func acquirePath(file string, wait bool) (*os.File, error) {
+	for {
+		fd, err := os.OpenFile(file, os.O_CREATE|os.O_RDWR, 0600)
+		if err != nil {
+			return nil, err
+		}
+		locked := true
+		if wait {
+			err = lockFile(fd)
+		} else {
+			locked, err = tryLockFile(fd)
+		}
+		if err != nil || !locked {
+			fd.Close()
+			return nil, err
+		}
+		lockedInfo, err := fd.Stat()
+		if err != nil {
+			fd.Close()
+			return nil, err
+		}
+		currentInfo, err := os.Stat(file)
+		if err == nil && os.SameFile(lockedInfo, currentInfo) {
+			return fd, nil
+		}
+		fd.Close()
+	}
+}
@@ -0,0 +1,51 @@
+//go:build !windows
+// +build !windows
+
+/*
+ * Copyright 2018 The minirepo authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minirepo
+
+import (
+	"golang.org/x/sys/unix"
+	"os"
+)
+
+// lockFile blocks until it acquired an exclusive lock on 'fd'. The lock is released when 'fd' is closed.
+func lockFile(fd *os.File) error {
+	for {
+		err := unix.Flock(int(fd.Fd()), unix.LOCK_EX)
+		if err != unix.EINTR {
+			return err
+		}
+	}
+}
+
+// tryLockFile acquires an exclusive lock on 'fd' if it is available. Returns whether the lock was acquired.
+func tryLockFile(fd *os.File) (bool, error) {
+	for {
+		err := unix.Flock(int(fd.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+		switch err {
+		case nil:
+			return true, nil
+		case unix.EWOULDBLOCK:
+			return false, nil
+		case unix.EINTR:
+		default:
+			return false, err
+		}
+	}
+}
@@ -0,0 +1,82 @@
+/*
+ * Copyright 2018 The minirepo authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minirepo
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"time"
+)
+
+// mirror is a single location the repository can be fetched from. As both metadata and files are verified, mirrors
+// don't need to be trusted.
+type mirror struct {
+	// Base URL
+	url string
+	// Point in time until which the mirror is skipped because it failed
+	failedUntil time.Time
+}
+
+// isMirrorFault decides whether 'err' indicates a problem with the mirror (as opposed to a local problem), so that
+// another mirror should be tried
+func isMirrorFault(err error) bool {
+	var statusErr *HTTPStatusError
+	var urlErr *url.Error
+	return isTemporary(err) || errors.As(err, &statusErr) || errors.As(err, &urlErr) ||
+		errors.Is(err, ErrChecksumMismatch) || errors.Is(err, ErrSizeMismatch) || errors.Is(err, ErrSignatureInvalid) ||
+		errors.Is(err, ErrRollback) || errors.Is(err, ErrMetadataExpired)
+}
+
+// eachMirror calls 'attempt' with the base URL of each mirror until it succeeds. Mirrors which failed recently are only
+// tried after all others. If 'attempt' fails due to a problem with the mirror, the mirror is skipped for the cooldown
+// period and the next one is tried. Other errors are returned immediately.
+func (m *Minirepo) eachMirror(ctx context.Context, attempt func(base string) error) error {
+	now := time.Now()
+	var healthy, failed []*mirror
+	m.mirrorLock.Lock()
+	for _, item := range m.mirrors {
+		if now.Before(item.failedUntil) {
+			failed = append(failed, item)
+		} else {
+			healthy = append(healthy, item)
+		}
+	}
+	m.mirrorLock.Unlock()
+
+	var err error
+	for _, item := range append(healthy, failed...) {
+		err = attempt(item.url)
+		if err == nil {
+			m.setMirrorFailed(item, time.Time{})
+			return nil
+		}
+		if !isMirrorFault(err) || ctx.Err() != nil {
+			return err
+		}
+		m.logger.WithError(err).WithField("mirror", item.url).Warn("Mirror failed, trying next one")
+		m.setMirrorFailed(item, time.Now().Add(m.mirrorCooldown))
+	}
+	return err
+}
+
+// setMirrorFailed marks 'item' as failed until 'until', a zero time marks it as healthy
+func (m *Minirepo) setMirrorFailed(item *mirror, until time.Time) {
+	m.mirrorLock.Lock()
+	defer m.mirrorLock.Unlock()
+	item.failedUntil = until
+}
@@ -0,0 +1,197 @@
+/*
+ * Copyright 2018 The minirepo authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minirepo
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/openpgp"
+	"math/rand"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Option configures a client created by NewRepoClientWithOptions
+type Option func(m *Minirepo) error
+
+// RetryPolicy decides how often and how fast failed requests are retried. Only transient network errors (timeouts,
+// failed connections and interrupted transfers) and HTTP 5xx responses are retried, interrupted file downloads are
+// resumed where they stopped.
+type RetryPolicy struct {
+	// Maximum number of attempts per request, including the first one. Values below 1 are treated as 1.
+	MaxAttempts int
+	// Delay before the first retry. The delay doubles with every further retry.
+	InitialDelay time.Duration
+	// Upper limit for the delay between retries, 0 for no limit
+	MaxDelay time.Duration
+	// Fraction of the delay which is randomized, e.g. 0.2 to wait between 80% and 120% of the delay. This avoids many
+	// clients retrying in lockstep.
+	Jitter float64
+}
+
+// delay returns how long to wait before attempt number 'attempt' (starting at 1 for the first retry)
+func (p RetryPolicy) delay(attempt int) time.Duration {
+	delay := p.InitialDelay
+	for i := 1; i < attempt && (p.MaxDelay == 0 || delay < p.MaxDelay); i++ {
+		delay *= 2
+	}
+	if p.MaxDelay > 0 && delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	if p.Jitter > 0 {
+		delay = time.Duration(float64(delay) * (1 - p.Jitter + 2*p.Jitter*rand.Float64()))
+	}
+	return delay
+}
+
+// NewRepoClientWithOptions creates a new minirepo client.
+//  - localCache is expected to contain a directory where the repository downloads should be cached
+//  - url is expected to contain a repositories upstream. Further mirrors can be added using WithMirrors.
+//  - options configure the client. At least one signing key needs to be passed using WithSigningKeys.
+func NewRepoClientWithOptions(localCache, url string, options ...Option) (*Minirepo, error) {
+	m := newRepoClient(localCache, url)
+	for _, option := range options {
+		err := option(m)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(m.signingKeys) == 0 {
+		return nil, errors.New("no signing key specified")
+	}
+	trust, err := m.trustedKeys(nil)
+	if err != nil {
+		return nil, err
+	}
+	if m.signatureThreshold > len(trust.origins) {
+		// The metadata could never be accepted
+		return nil, fmt.Errorf("signature threshold %d exceeds the number of signing keys (%d)", m.signatureThreshold,
+			len(trust.origins))
+	}
+	return m, nil
+}
+
+// WithSigningKeys adds trusted keys for verifying the metadata. Each key is expected to contain one or more full
+// ASCII-armored GPG public keys. By default, metadata is accepted if it was signed by any of the trusted keys, see
+// WithSignatureThreshold.
+func WithSigningKeys(keys ...string) Option {
+	return func(m *Minirepo) error {
+		for _, key := range keys {
+			_, err := openpgp.ReadArmoredKeyRing(strings.NewReader(key))
+			if err != nil {
+				return fmt.Errorf("keyring decode failed: %s", err)
+			}
+			m.signingKeys = append(m.signingKeys, key)
+		}
+		return nil
+	}
+}
+
+// WithSignatureThreshold sets how many different trusted keys need to sign the metadata, see SetSignatureThreshold.
+// NewRepoClientWithOptions fails if the threshold exceeds the number of keys passed using WithSigningKeys.
+func WithSignatureThreshold(threshold int) Option {
+	return func(m *Minirepo) error {
+		m.SetSignatureThreshold(threshold)
+		return nil
+	}
+}
+
+// WithMirrors adds further mirrors of the repository. Mirrors are tried in order, starting with the upstream passed to
+// NewRepoClientWithOptions. If a mirror fails due to network errors, unexpected status codes or invalid content, the
+// next one is tried and the failing one is skipped for the cooldown period (see WithMirrorCooldown).
+func WithMirrors(urls ...string) Option {
+	return func(m *Minirepo) error {
+		for _, url := range urls {
+			m.mirrors = append(m.mirrors, &mirror{url: url})
+		}
+		return nil
+	}
+}
+
+// WithMirrorCooldown sets how long a failed mirror is skipped. The default is 5 minutes.
+func WithMirrorCooldown(cooldown time.Duration) Option {
+	return func(m *Minirepo) error {
+		m.mirrorCooldown = cooldown
+		return nil
+	}
+}
+
+// WithHTTPClient sets the HTTP client used for all requests, see SetHTTPClient
+func WithHTTPClient(client *http.Client) Option {
+	return func(m *Minirepo) error {
+		m.SetHTTPClient(client)
+		return nil
+	}
+}
+
+// WithTransport sets the transport used for all requests, see SetTransport
+func WithTransport(transport http.RoundTripper) Option {
+	return func(m *Minirepo) error {
+		m.SetTransport(transport)
+		return nil
+	}
+}
+
+// WithVerifyMode sets how cached files are verified, see SetVerifyMode
+func WithVerifyMode(mode VerifyMode) Option {
+	return func(m *Minirepo) error {
+		m.SetVerifyMode(mode)
+		return nil
+	}
+}
+
+// WithRetryPolicy sets how failed requests are retried. By default, requests are not retried.
+func WithRetryPolicy(policy RetryPolicy) Option {
+	return func(m *Minirepo) error {
+		m.retryPolicy = policy
+		return nil
+	}
+}
+
+// WithLogger sets the logger used for diagnostic messages. By default, the standard logrus logger is used.
+func WithLogger(logger log.FieldLogger) Option {
+	return func(m *Minirepo) error {
+		m.logger = logger
+		return nil
+	}
+}
+
+// WithUserAgent sets the User-Agent header sent with all requests
+func WithUserAgent(userAgent string) Option {
+	return func(m *Minirepo) error {
+		m.userAgent = userAgent
+		return nil
+	}
+}
+
+// WithMaxFileSize sets the maximum size of a single file download, see SetMaxFileSize
+func WithMaxFileSize(size int64) Option {
+	return func(m *Minirepo) error {
+		m.SetMaxFileSize(size)
+		return nil
+	}
+}
+
+// WithMaxCacheSize sets the maximum size of the local cache, see SetMaxCacheSize
+func WithMaxCacheSize(size int64) Option {
+	return func(m *Minirepo) error {
+		m.SetMaxCacheSize(size)
+		return nil
+	}
+}
@@ -0,0 +1,140 @@
+/*
+ * Copyright 2018 The minirepo authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minirepo
+
+import (
+	"bytes"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// flakyTransport fails the first 'failures' requests and records the User-Agent of all requests
+type flakyTransport struct {
+	failures   int
+	userAgents []string
+}
+
+func (f *flakyTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	f.userAgents = append(f.userAgents, request.Header.Get("User-Agent"))
+	if f.failures > 0 {
+		f.failures--
+		return nil, &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}
+	}
+	return http.DefaultTransport.RoundTrip(request)
+}
+
+// generateArmoredKey returns a new, unrelated ASCII-armored public key
+func generateArmoredKey() (string, error) {
+	entity, err := openpgp.NewEntity("Other", "", "", nil)
+	if err != nil {
+		return "", err
+	}
+	buf := &bytes.Buffer{}
+	out, err := armor.Encode(buf, openpgp.PublicKeyType, nil)
+	if err != nil {
+		return "", err
+	}
+	err = entity.Serialize(out)
+	if err != nil {
+		return "", err
+	}
+	out.Close()
+	return buf.String(), nil
+}
+
+func TestOptions(t *testing.T) {
+	client, server, err := InitTestClient()
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	defer server.Shutdown(nil)
+	pubkeyBin, err := ioutil.ReadFile(path.Join(path.Dir(client.localCache), "pub.asc"))
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	otherKey, err := generateArmoredKey()
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+
+	_, err = NewRepoClientWithOptions(client.localCache, client.mirrors[0].url)
+	if err == nil || err.Error() != "no signing key specified" {
+		t.Fatal("Unexpected error: ", err)
+	}
+	_, err = NewRepoClientWithOptions(client.localCache, client.mirrors[0].url, WithSigningKeys("invalid"))
+	if err == nil {
+		t.Fatal("Expected error missing")
+	}
+	_, err = NewRepoClientWithOptions(client.localCache, client.mirrors[0].url,
+		WithSigningKeys(otherKey, string(pubkeyBin)), WithSignatureThreshold(3))
+	if err == nil {
+		t.Fatal("Expected error missing")
+	}
+	_, err = NewRepoClientWithOptions(client.localCache, client.mirrors[0].url,
+		WithSigningKeys(otherKey, string(pubkeyBin)), WithSignatureThreshold(2))
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+
+	transport := &flakyTransport{failures: 2}
+	newClient, err := NewRepoClientWithOptions(client.localCache, client.mirrors[0].url,
+		WithSigningKeys(otherKey, string(pubkeyBin)),
+		WithTransport(transport),
+		WithUserAgent("minirepo-test"),
+		WithRetryPolicy(RetryPolicy{
+			MaxAttempts:  3,
+			InitialDelay: time.Millisecond,
+		}),
+	)
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	err = forgetValidators(newClient)
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	fresh, err := newClient.TryUpdate()
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	if fresh != Updated {
+		t.Fatal("Metadata should have been fetched after retrying")
+	}
+	for _, userAgent := range transport.userAgents {
+		if userAgent != "minirepo-test" {
+			t.Fatal("Unexpected User-Agent: ", userAgent)
+		}
+	}
+
+	// Without retries, the request should fail
+	transport.failures = 1
+	newClient.retryPolicy.MaxAttempts = 1
+	fresh, err = newClient.TryUpdate()
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	if fresh != NotUpdated {
+		t.Fatal("Metadata should have been cached copy")
+	}
+}
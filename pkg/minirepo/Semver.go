@@ -0,0 +1,269 @@
+/*
+ * Copyright 2018 The minirepo authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minirepo
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Version is a semantic version as described on https://semver.org. Versions may be prefixed with 'v', and minor and
+// patch version may be omitted, so '1.2' and 'v1.2.0' are both valid.
+type Version struct {
+	Major, Minor, Patch uint64
+	// Pre-release identifiers, e.g. ["rc", "1"] for '1.0.0-rc.1'
+	Prerelease []string
+	// Build metadata, which is ignored when comparing versions
+	Build string
+	// Number of version numbers specified when parsing, between 1 and 3
+	parts int
+	// Text the version was parsed from
+	original string
+}
+
+// ParseVersion parses the semantic version 'text'
+func ParseVersion(text string) (*Version, error) {
+	version := &Version{
+		original: text,
+	}
+	rest := strings.TrimPrefix(text, "v")
+	if idx := strings.IndexByte(rest, '+'); idx >= 0 {
+		version.Build = rest[idx+1:]
+		rest = rest[:idx]
+		if version.Build == "" {
+			return nil, fmt.Errorf("invalid version %q: empty build metadata", text)
+		}
+	}
+	if idx := strings.IndexByte(rest, '-'); idx >= 0 {
+		version.Prerelease = strings.Split(rest[idx+1:], ".")
+		rest = rest[:idx]
+		for _, identifier := range version.Prerelease {
+			if identifier == "" {
+				return nil, fmt.Errorf("invalid version %q: empty pre-release identifier", text)
+			}
+		}
+	}
+
+	numbers := strings.Split(rest, ".")
+	if len(numbers) > 3 {
+		return nil, fmt.Errorf("invalid version %q: too many parts", text)
+	}
+	fields := []*uint64{&version.Major, &version.Minor, &version.Patch}
+	for i, number := range numbers {
+		value, err := strconv.ParseUint(number, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid version %q: %s", text, err)
+		}
+		*fields[i] = value
+	}
+	version.parts = len(numbers)
+	return version, nil
+}
+
+// String returns the text the version was parsed from
+func (v *Version) String() string {
+	return v.original
+}
+
+// Compare returns -1, 0 or +1 depending on whether 'v' is lower than, equal to or greater than 'other' according to
+// semantic versioning precedence
+func (v *Version) Compare(other *Version) int {
+	for _, pair := range [][2]uint64{{v.Major, other.Major}, {v.Minor, other.Minor}, {v.Patch, other.Patch}} {
+		if pair[0] != pair[1] {
+			if pair[0] < pair[1] {
+				return -1
+			}
+			return 1
+		}
+	}
+
+	// A pre-release has lower precedence than the release itself
+	if len(v.Prerelease) == 0 || len(other.Prerelease) == 0 {
+		return compareInt(len(other.Prerelease), len(v.Prerelease))
+	}
+	for i := 0; i < len(v.Prerelease) && i < len(other.Prerelease); i++ {
+		result := compareIdentifier(v.Prerelease[i], other.Prerelease[i])
+		if result != 0 {
+			return result
+		}
+	}
+	return compareInt(len(v.Prerelease), len(other.Prerelease))
+}
+
+// compareIdentifier compares two pre-release identifiers. Numeric identifiers are compared numerically and have lower
+// precedence than alphanumeric ones.
+func compareIdentifier(a, b string) int {
+	aNum, aErr := strconv.ParseUint(a, 10, 64)
+	bNum, bErr := strconv.ParseUint(b, 10, 64)
+	switch {
+	case aErr == nil && bErr == nil:
+		if aNum == bNum {
+			return 0
+		} else if aNum < bNum {
+			return -1
+		}
+		return 1
+	case aErr == nil:
+		return -1
+	case bErr == nil:
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+// compareInt returns -1, 0 or +1 depending on whether 'a' is lower than, equal to or greater than 'b'
+func compareInt(a, b int) int {
+	if a < b {
+		return -1
+	} else if a > b {
+		return 1
+	}
+	return 0
+}
+
+// comparator is a single condition of a constraint, e.g. '>=1.2.0'
+type comparator struct {
+	operator string
+	version  *Version
+}
+
+// check returns whether 'v' satisfies the condition
+func (c *comparator) check(v *Version) bool {
+	result := v.Compare(c.version)
+	switch c.operator {
+	case "<":
+		return result < 0
+	case "<=":
+		return result <= 0
+	case ">":
+		return result > 0
+	case ">=":
+		return result >= 0
+	case "!=":
+		return result != 0
+	}
+	return result == 0
+}
+
+// Constraint is a set of conditions versions can be checked against
+type Constraint struct {
+	// Alternatives, each consisting of conditions which all need to be satisfied
+	alternatives [][]comparator
+}
+
+// ParseConstraint parses a version constraint. A constraint consists of alternatives separated by '||', a version
+// satisfies the constraint if it satisfies any alternative. Each alternative consists of conditions separated by spaces
+// or commas, all of which need to be satisfied. Supported conditions are
+//  - '=1.2.3' or '1.2.3': exactly this version. Omitted parts match anything, so '1.2' is the same as '>=1.2.0 <1.3.0'.
+//  - '!=1.2.3', '<1.2.3', '<=1.2.3', '>1.2.3', '>=1.2.3': compare to the version, omitted parts are 0
+//  - '^1.2.3': compatible versions, i.e. '>=1.2.3 <2.0.0'. For versions below 1.0.0, the first non-zero part may not
+//    change, so '^0.2.3' is '>=0.2.3 <0.3.0'.
+//  - '~1.2.3': patch releases, i.e. '>=1.2.3 <1.3.0'. '~1' allows minor releases as well.
+//  - '*' or an empty constraint: any version
+// Pre-releases only satisfy an alternative if one of its conditions refers to a pre-release of the same version.
+func ParseConstraint(text string) (*Constraint, error) {
+	constraint := &Constraint{}
+	for _, alternativeText := range strings.Split(text, "||") {
+		alternative := []comparator{}
+		terms := strings.FieldsFunc(alternativeText, func(r rune) bool {
+			return r == ' ' || r == ',' || r == '\t'
+		})
+		for _, term := range terms {
+			comparators, err := parseTerm(term)
+			if err != nil {
+				return nil, fmt.Errorf("invalid constraint %q: %s", text, err)
+			}
+			alternative = append(alternative, comparators...)
+		}
+		constraint.alternatives = append(constraint.alternatives, alternative)
+	}
+	return constraint, nil
+}
+
+// parseTerm converts a single condition of a constraint to comparators
+func parseTerm(term string) ([]comparator, error) {
+	if term == "*" {
+		return nil, nil
+	}
+	operator := ""
+	for _, candidate := range []string{">=", "<=", "!=", ">", "<", "=", "^", "~"} {
+		if strings.HasPrefix(term, candidate) {
+			operator = candidate
+			break
+		}
+	}
+	version, err := ParseVersion(term[len(operator):])
+	if err != nil {
+		return nil, err
+	}
+
+	switch operator {
+	case "^":
+		upper := &Version{}
+		switch {
+		case version.Major > 0 || version.parts == 1:
+			upper.Major = version.Major + 1
+		case version.Minor > 0 || version.parts == 2:
+			upper.Minor = version.Minor + 1
+		default:
+			upper.Patch = version.Patch + 1
+		}
+		return []comparator{{">=", version}, {"<", upper}}, nil
+	case "~":
+		return []comparator{{">=", version}, {"<", nextRelease(version, version.parts)}}, nil
+	case "", "=":
+		if version.parts < 3 {
+			return []comparator{{">=", version}, {"<", nextRelease(version, version.parts)}}, nil
+		}
+		return []comparator{{"=", version}}, nil
+	}
+	return []comparator{{operator, version}}, nil
+}
+
+// nextRelease returns the lowest version that differs from 'version' in the first 'parts' version numbers
+func nextRelease(version *Version, parts int) *Version {
+	if parts == 1 {
+		return &Version{Major: version.Major + 1}
+	}
+	return &Version{Major: version.Major, Minor: version.Minor + 1}
+}
+
+// Check returns whether 'v' satisfies the constraint
+func (c *Constraint) Check(v *Version) bool {
+	for _, alternative := range c.alternatives {
+		if checkAlternative(alternative, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkAlternative returns whether 'v' satisfies all comparators of 'alternative'
+func checkAlternative(alternative []comparator, v *Version) bool {
+	allowPrerelease := len(v.Prerelease) == 0
+	for _, item := range alternative {
+		if !item.check(v) {
+			return false
+		}
+		if len(item.version.Prerelease) > 0 && item.version.Major == v.Major && item.version.Minor == v.Minor &&
+			item.version.Patch == v.Patch {
+			allowPrerelease = true
+		}
+	}
+	return allowPrerelease
+}
@@ -0,0 +1,104 @@
+/*
+ * Copyright 2018 The minirepo authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minirepo
+
+import (
+	"testing"
+)
+
+func TestVersionCompare(t *testing.T) {
+	// Sorted by precedence
+	versions := []string{"0.9", "1.0.0-alpha", "1.0.0-alpha.1", "1.0.0-alpha.beta", "1.0.0-beta.2", "1.0.0-beta.11",
+		"1.0.0-rc.1", "v1.0.0+build", "1.0.1", "1.10.0", "2"}
+	for i := range versions {
+		for j := range versions {
+			a, err := ParseVersion(versions[i])
+			if err != nil {
+				t.Fatal("Unexpected error: ", err)
+			}
+			b, err := ParseVersion(versions[j])
+			if err != nil {
+				t.Fatal("Unexpected error: ", err)
+			}
+			if result := a.Compare(b); result != compareInt(i, j) {
+				t.Fatal("Unexpected result comparing ", a, " to ", b, ": ", result)
+			}
+		}
+	}
+
+	for _, invalid := range []string{"", "1.2.3.4", "a.b", "1.2.3-", "1.2.3-rc..1", "1.2.3+", "-1"} {
+		_, err := ParseVersion(invalid)
+		if err == nil {
+			t.Fatal("Expected error for ", invalid)
+		}
+	}
+}
+
+func TestConstraint(t *testing.T) {
+	tests := []struct {
+		constraint string
+		matching   []string
+		other      []string
+	}{
+		{"^1.2", []string{"1.2.0", "1.9.3"}, []string{"1.1.9", "2.0.0", "2.0.0-rc.1", "1.5.0-rc.1"}},
+		{"^0.2.3", []string{"0.2.3", "0.2.9"}, []string{"0.3.0", "0.2.2"}},
+		{"^0.0.3", []string{"0.0.3"}, []string{"0.0.4"}},
+		{"~1.2.3", []string{"1.2.3", "1.2.9"}, []string{"1.3.0", "1.2.2"}},
+		{"~1", []string{"1.0.0", "1.9.0"}, []string{"2.0.0"}},
+		{">=2.0 <3", []string{"2.0.0", "2.9.9"}, []string{"1.9.9", "3.0.0", "3.0.0-rc.1"}},
+		{">=2.0, <3", []string{"2.5.0"}, []string{"3.0.0"}},
+		{"1.2", []string{"1.2.0", "1.2.7"}, []string{"1.3.0"}},
+		{"=1.2.3", []string{"1.2.3", "v1.2.3+build"}, []string{"1.2.4"}},
+		{"<1 || >=2 !=2.1.0", []string{"0.5.0", "2.0.0", "2.2.0"}, []string{"1.0.0", "2.1.0"}},
+		{">=1.0.0-rc.1", []string{"1.0.0-rc.2", "1.0.0", "1.1.0"}, []string{"1.0.0-beta", "1.1.0-rc.1"}},
+		{"*", []string{"0.0.1", "1.0.0"}, []string{"1.0.0-rc.1"}},
+		{"", []string{"1.0.0"}, nil},
+	}
+	for _, test := range tests {
+		constraint, err := ParseConstraint(test.constraint)
+		if err != nil {
+			t.Fatal("Unexpected error: ", err)
+		}
+		for _, text := range append(test.matching, test.other...) {
+			version, err := ParseVersion(text)
+			if err != nil {
+				t.Fatal("Unexpected error: ", err)
+			}
+			expected := contains(test.matching, text)
+			if constraint.Check(version) != expected {
+				t.Fatal("Unexpected result checking ", text, " against ", test.constraint)
+			}
+		}
+	}
+
+	for _, invalid := range []string{"^", ">=a", "1.2 <x"} {
+		_, err := ParseConstraint(invalid)
+		if err == nil {
+			t.Fatal("Expected error for ", invalid)
+		}
+	}
+}
+
+// contains returns whether 'list' contains 'item'
+func contains(list []string, item string) bool {
+	for _, candidate := range list {
+		if candidate == item {
+			return true
+		}
+	}
+	return false
+}
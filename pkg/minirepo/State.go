@@ -0,0 +1,112 @@
+/*
+ * Copyright 2018 The minirepo authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minirepo
+
+import (
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+)
+
+// clientState contains everything the client needs to remember between runs apart from the metadata itself
+type clientState struct {
+	// Timestamp of the newest metadata accepted so far
+	Timestamp time.Time
+	// Base URL of the mirror the local copy of the metadata was fetched from
+	MetaSource string `yaml:",omitempty"`
+	// ETag of the local copy of the metadata as sent by MetaSource
+	ETag string `yaml:",omitempty"`
+	// Last-Modified header of the local copy of the metadata as sent by MetaSource
+	LastModified string `yaml:",omitempty"`
+	// Cached files, keyed by their path inside the repository
+	Files map[string]cachedFile `yaml:",omitempty"`
+}
+
+// cachedFile contains what the client knows about a file in its cache
+type cachedFile struct {
+	// Hash from the metadata the file was downloaded for
+	Hash string
+	// Size of the file in bytes when it was verified
+	Size int64
+	// Modification time in nanoseconds since the epoch when the file was verified
+	MTime int64
+	// Time of the last access in nanoseconds since the epoch
+	Accessed int64
+}
+
+// loadState reads the client state from the cache directory. If there is no state yet, an empty one is returned.
+func (m *Minirepo) loadState() (*clientState, error) {
+	state := &clientState{
+		Files: make(map[string]cachedFile),
+	}
+	stateBin, err := ioutil.ReadFile(path.Join(m.localCache, "state.yml"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return state, nil
+		}
+		return nil, fmt.Errorf("state read failed: %s", err)
+	}
+	err = yaml.Unmarshal(stateBin, state)
+	if err != nil {
+		return nil, fmt.Errorf("state decode failed: %s", err)
+	}
+	if state.Files == nil {
+		state.Files = make(map[string]cachedFile)
+	}
+	return state, nil
+}
+
+// saveState atomically replaces the client state in the cache directory
+func (m *Minirepo) saveState(state *clientState) error {
+	stateBin, err := yaml.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path.Join(m.localCache, "state.yml"), stateBin)
+}
+
+// saveMeta writes the metadata 'metaYml' and its signature 'metaAsc' to the cache directory. Both files are written
+// completely before either of them is replaced, so a failed write doesn't leave a local copy that fails verification.
+func (m *Minirepo) saveMeta(metaYml, metaAsc []byte) error {
+	metaFile := path.Join(m.localCache, "meta.yml")
+	sigFile := path.Join(m.localCache, "meta.asc")
+	err := ioutil.WriteFile(metaFile+".tmp", metaYml, 0600)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(sigFile+".tmp", metaAsc, 0600)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(sigFile+".tmp", sigFile)
+	if err != nil {
+		return err
+	}
+	return os.Rename(metaFile+".tmp", metaFile)
+}
+
+// writeFileAtomic replaces 'file' with 'data' by writing a temporary file first and renaming it
+func writeFileAtomic(file string, data []byte) error {
+	err := ioutil.WriteFile(file+".tmp", data, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(file+".tmp", file)
+}
@@ -0,0 +1,262 @@
+/*
+ * Copyright 2018 The minirepo authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minirepo
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"github.com/uubk/minirepo/pkg/minirepo/types"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/openpgp/packet"
+	"gopkg.in/yaml.v2"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+// keyHistoryName is the file in the root of the cache directory containing the metadata that changed the trusted keys
+const keyHistoryName = "keyhistory.yml"
+
+// signedMeta is metadata together with its detached signature
+type signedMeta struct {
+	// Metadata in YAML encoding
+	Meta string
+	// ASCII-armored detached signature of Meta
+	Signature string
+}
+
+// trustedKeys contains the keys trusted for verifying metadata. These are the configured keys and the keys announced
+// in trusted metadata, minus the keys which were replaced by their successor.
+type trustedKeys struct {
+	// Keys that are currently trusted
+	keyring openpgp.EntityList
+	// Key each adopted key replaces, keyed by fingerprint
+	predecessors map[[20]byte][20]byte
+	// Configured key each trusted key descends from, keyed by fingerprint. Signatures by keys with the same origin
+	// count as a single signature.
+	origins map[[20]byte][20]byte
+}
+
+// trustedKeys determines the keys currently trusted by starting with the configured keys and applying the key changes
+// in 'history' in order. As the cache directory isn't authenticated, each entry is verified against the keys trusted
+// at its point, entries that fail verification are skipped.
+func (m *Minirepo) trustedKeys(history []signedMeta) (*trustedKeys, error) {
+	trust := &trustedKeys{
+		predecessors: make(map[[20]byte][20]byte),
+		origins:      make(map[[20]byte][20]byte),
+	}
+	for _, key := range m.signingKeys {
+		keys, err := openpgp.ReadArmoredKeyRing(strings.NewReader(key))
+		if err != nil {
+			return nil, fmt.Errorf("keyring decode failed: %s", err)
+		}
+		for _, entity := range keys {
+			trust.origins[entity.PrimaryKey.Fingerprint] = entity.PrimaryKey.Fingerprint
+		}
+		trust.keyring = append(trust.keyring, keys...)
+	}
+
+	// Key changes were logged when they happened, so replay them quietly
+	quiet := log.New()
+	quiet.Out = ioutil.Discard
+	for _, entry := range history {
+		signers, err := trust.verify([]byte(entry.Meta), []byte(entry.Signature), m.signatureThreshold)
+		if err != nil {
+			m.logger.WithError(err).Warn("Ignoring invalid key history entry")
+			continue
+		}
+		meta := &types.RepoInfo{}
+		err = yaml.Unmarshal([]byte(entry.Meta), meta)
+		if err != nil {
+			m.logger.WithError(err).Warn("Ignoring invalid key history entry")
+			continue
+		}
+		trust.update(meta, []byte(entry.Meta), []byte(entry.Signature), signers, quiet)
+	}
+	return trust, nil
+}
+
+// verify checks the detached signature 'metaAsc' of the metadata 'metaYml'. The signature file may contain signatures
+// by several keys, at least 'threshold' of which need to be valid and trusted. A key and its successor only count once,
+// as both belong to the same signer during a key rotation. Returns the fingerprints of all keys with a valid signature.
+func (t *trustedKeys) verify(metaYml, metaAsc []byte, threshold int) (map[[20]byte]bool, error) {
+	signers, err := signedBy(t.keyring, metaYml, metaAsc)
+	if err != nil {
+		return nil, err
+	}
+	origins := make(map[[20]byte]bool)
+	for signer := range signers {
+		origins[t.origins[signer]] = true
+	}
+	if len(origins) < threshold {
+		return nil, fmt.Errorf("%w: %d of %d required signatures valid", ErrSignatureInvalid, len(origins), threshold)
+	}
+	return signers, nil
+}
+
+// signedBy returns the fingerprints of the keys in 'keyring' with a valid signature in the detached signature
+// 'metaAsc' of the metadata 'metaYml'
+func signedBy(keyring openpgp.EntityList, metaYml, metaAsc []byte) (map[[20]byte]bool, error) {
+	// Check each signature on its own
+	block, err := armor.Decode(bytes.NewReader(metaAsc))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrSignatureInvalid, err)
+	}
+	signers := make(map[[20]byte]bool)
+	packets := packet.NewReader(block.Body)
+	for {
+		p, err := packets.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrSignatureInvalid, err)
+		}
+		sig, ok := p.(*packet.Signature)
+		if !ok {
+			continue
+		}
+		sigBin := &bytes.Buffer{}
+		err = sig.Serialize(sigBin)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrSignatureInvalid, err)
+		}
+		signer, err := openpgp.CheckDetachedSignature(keyring, bytes.NewReader(metaYml), sigBin)
+		if err == nil {
+			signers[signer.PrimaryKey.Fingerprint] = true
+		}
+	}
+	return signers, nil
+}
+
+// update applies the key changes of 'meta', which needs to be verified already and was signed by the trusted keys
+// 'signers'. 'metaYml' and 'metaAsc' are the metadata and its signature. Announced keys are adopted if both the new key
+// and the trusted key it replaces signed the metadata, as happens during a key rotation. Keys whose successor signed
+// the metadata without them are retired. Returns whether the trusted keys changed.
+func (t *trustedKeys) update(meta *types.RepoInfo, metaYml, metaAsc []byte, signers map[[20]byte]bool,
+	logger log.FieldLogger) bool {
+	changed := false
+	for _, announced := range meta.NextKeys {
+		keys, err := openpgp.ReadArmoredKeyRing(strings.NewReader(announced.Key))
+		if err != nil || len(keys) != 1 {
+			logger.WithField("fingerprint", announced.Fingerprint).Warn("Ignoring invalid announced key")
+			continue
+		}
+		fingerprint := keys[0].PrimaryKey.Fingerprint
+		if !strings.EqualFold(fmt.Sprintf("%X", fingerprint), announced.Fingerprint) {
+			logger.WithField("fingerprint", announced.Fingerprint).Warn("Ignoring announced key with wrong fingerprint")
+			continue
+		}
+		replaced, err := hex.DecodeString(announced.Replaces)
+		if err != nil || len(replaced) != len(fingerprint) || !t.trusts(toFingerprint(replaced)) {
+			logger.WithField("fingerprint", announced.Fingerprint).Warn(
+				"Ignoring announced key which doesn't replace a trusted key")
+			continue
+		}
+		if _, adopted := t.predecessors[fingerprint]; adopted || t.trusts(fingerprint) {
+			continue
+		}
+		// Otherwise, any signers reaching the threshold could replace the key of another signer
+		if !signers[toFingerprint(replaced)] {
+			logger.WithField("fingerprint", announced.Fingerprint).Warn(
+				"Ignoring announced key which wasn't announced by the key it replaces")
+			continue
+		}
+		newSigners, err := signedBy(keys, metaYml, metaAsc)
+		if err != nil || !newSigners[fingerprint] {
+			logger.WithField("fingerprint", announced.Fingerprint).Warn(
+				"Ignoring announced key which didn't sign the metadata")
+			continue
+		}
+		logger.WithField("fingerprint", announced.Fingerprint).Info("Adopting announced signing key")
+		t.keyring = append(t.keyring, keys[0])
+		t.predecessors[fingerprint] = toFingerprint(replaced)
+		t.origins[fingerprint] = t.origins[toFingerprint(replaced)]
+		changed = true
+	}
+
+	for signer := range signers {
+		predecessor, ok := t.predecessors[signer]
+		if ok && !signers[predecessor] && t.trusts(predecessor) {
+			logger.WithField("fingerprint", fmt.Sprintf("%X", predecessor)).Info(
+				"Retiring signing key replaced by its successor")
+			t.retire(predecessor)
+			changed = true
+		}
+	}
+	return changed
+}
+
+// trusts returns whether the key with the fingerprint 'fingerprint' is trusted
+func (t *trustedKeys) trusts(fingerprint [20]byte) bool {
+	for _, entity := range t.keyring {
+		if entity.PrimaryKey.Fingerprint == fingerprint {
+			return true
+		}
+	}
+	return false
+}
+
+// retire stops trusting the key with the fingerprint 'fingerprint'
+func (t *trustedKeys) retire(fingerprint [20]byte) {
+	keyring := t.keyring[:0]
+	for _, entity := range t.keyring {
+		if entity.PrimaryKey.Fingerprint != fingerprint {
+			keyring = append(keyring, entity)
+		}
+	}
+	t.keyring = keyring
+}
+
+// toFingerprint converts the 20 bytes in 'data' into a fingerprint
+func toFingerprint(data []byte) [20]byte {
+	var fingerprint [20]byte
+	copy(fingerprint[:], data)
+	return fingerprint
+}
+
+// loadKeyHistory reads the metadata that changed the trusted keys from the cache directory, in the order it was
+// accepted
+func (m *Minirepo) loadKeyHistory() ([]signedMeta, error) {
+	historyBin, err := ioutil.ReadFile(path.Join(m.localCache, keyHistoryName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("key history read failed: %s", err)
+	}
+	var history []signedMeta
+	err = yaml.Unmarshal(historyBin, &history)
+	if err != nil {
+		return nil, fmt.Errorf("key history decode failed: %s", err)
+	}
+	return history, nil
+}
+
+// saveKeyHistory atomically replaces the key history in the cache directory
+func (m *Minirepo) saveKeyHistory(history []signedMeta) error {
+	historyBin, err := yaml.Marshal(history)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path.Join(m.localCache, keyHistoryName), historyBin)
+}
@@ -0,0 +1,202 @@
+/*
+ * Copyright 2018 The minirepo authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minirepo
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/uubk/minirepo/pkg/minirepo/types"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+// generateEntity creates a new key, returning it together with its ASCII-armored public key
+func generateEntity(name string) (*openpgp.Entity, string, error) {
+	entity, err := openpgp.NewEntity(name, "", "", nil)
+	if err != nil {
+		return nil, "", err
+	}
+	pubkey := &bytes.Buffer{}
+	out, err := armor.Encode(pubkey, openpgp.PublicKeyType, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	err = entity.Serialize(out)
+	if err != nil {
+		return nil, "", err
+	}
+	out.Close()
+	return entity, pubkey.String(), nil
+}
+
+// signMeta encodes 'meta' and signs it by 'signers', returning the metadata and the signature
+func signMeta(meta *types.RepoInfo, signers ...*openpgp.Entity) ([]byte, []byte, error) {
+	metaYml, err := yaml.Marshal(meta)
+	if err != nil {
+		return nil, nil, err
+	}
+	metaAsc := &bytes.Buffer{}
+	out, err := armor.Encode(metaAsc, openpgp.SignatureType, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, signer := range signers {
+		err = openpgp.DetachSign(out, signer, bytes.NewReader(metaYml), nil)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	out.Close()
+	return metaYml, metaAsc.Bytes(), nil
+}
+
+func TestForgedKeyHistory(t *testing.T) {
+	client, server, err := InitTestClient()
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	defer server.Shutdown(nil)
+
+	trusted, err := openpgp.ReadArmoredKeyRing(strings.NewReader(client.signingKeys[0]))
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	attacker, attackerKey, err := generateEntity("Attacker")
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+
+	// Someone with write access to the cache claims that the trusted key announced the attacker's key
+	metaYml, metaAsc, err := signMeta(&types.RepoInfo{
+		NextKeys: []types.AnnouncedKey{
+			{
+				Fingerprint: fmt.Sprintf("%X", attacker.PrimaryKey.Fingerprint),
+				Key:         attackerKey,
+				Replaces:    fmt.Sprintf("%X", trusted[0].PrimaryKey.Fingerprint),
+			},
+		},
+	}, attacker)
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	err = client.saveKeyHistory([]signedMeta{{Meta: string(metaYml), Signature: string(metaAsc)}})
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+
+	history, err := client.loadKeyHistory()
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	trust, err := client.trustedKeys(history)
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	if trust.trusts(attacker.PrimaryKey.Fingerprint) {
+		t.Fatal("Attacker key unexpectedly trusted")
+	}
+	if !trust.trusts(trusted[0].PrimaryKey.Fingerprint) {
+		t.Fatal("Configured key unexpectedly not trusted")
+	}
+	_, err = trust.verify(metaYml, metaAsc, client.signatureThreshold)
+	if err == nil {
+		t.Fatal("Metadata signed by the attacker unexpectedly accepted")
+	}
+}
+
+func TestAnnouncedKeyNotSigned(t *testing.T) {
+	client, server, err := InitTestClient()
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	defer server.Shutdown(nil)
+
+	trusted, err := openpgp.ReadArmoredKeyRing(strings.NewReader(client.signingKeys[0]))
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	other, otherKey, err := generateEntity("Other Signer")
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	client.signingKeys = append(client.signingKeys, otherKey)
+	next, nextKey, err := generateEntity("Next")
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+
+	for _, test := range []struct {
+		replaces *openpgp.Entity
+		signers  []*openpgp.Entity
+	}{
+		// Another trusted key can't replace the server's key
+		{trusted[0], []*openpgp.Entity{other, next}},
+		// The new key has to sign as well
+		{other, []*openpgp.Entity{other}},
+	} {
+		metaYml, metaAsc, err := signMeta(&types.RepoInfo{
+			Name:      "Unittest Server",
+			Timestamp: time.Now(),
+			NextKeys: []types.AnnouncedKey{
+				{
+					Fingerprint: fmt.Sprintf("%X", next.PrimaryKey.Fingerprint),
+					Key:         nextKey,
+					Replaces:    fmt.Sprintf("%X", test.replaces.PrimaryKey.Fingerprint),
+				},
+			},
+		}, test.signers...)
+		if err != nil {
+			t.Fatal("Unexpected error: ", err)
+		}
+		repoRoot := path.Join(path.Dir(client.localCache), "repo")
+		err = ioutil.WriteFile(path.Join(repoRoot, "meta.yml"), metaYml, 0600)
+		if err != nil {
+			t.Fatal("Unexpected error: ", err)
+		}
+		err = ioutil.WriteFile(path.Join(repoRoot, "meta.asc"), metaAsc, 0600)
+		if err != nil {
+			t.Fatal("Unexpected error: ", err)
+		}
+
+		// The metadata itself is fine, but the announced key isn't adopted
+		result, err := client.fetchMeta(context.Background(), false)
+		if err != nil || result != Updated {
+			t.Fatal("Unexpected result: ", result, err)
+		}
+		history, err := client.loadKeyHistory()
+		if err != nil {
+			t.Fatal("Unexpected error: ", err)
+		}
+		trust, err := client.trustedKeys(history)
+		if err != nil {
+			t.Fatal("Unexpected error: ", err)
+		}
+		if trust.trusts(next.PrimaryKey.Fingerprint) {
+			t.Fatal("Announced key unexpectedly trusted")
+		}
+		if !trust.trusts(test.replaces.PrimaryKey.Fingerprint) {
+			t.Fatal("Replaced key unexpectedly retired")
+		}
+	}
+}
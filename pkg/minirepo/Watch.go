@@ -0,0 +1,140 @@
+/*
+ * Copyright 2018 The minirepo authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minirepo
+
+import (
+	"context"
+	"github.com/uubk/minirepo/pkg/minirepo/types"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// ChangeEvent describes how the files in a repository changed between two metadata updates. Files are identified by
+// their path inside the repository, with segments separated by '/'.
+type ChangeEvent struct {
+	// Files that are new
+	Added []string
+	// Files that don't exist anymore
+	Removed []string
+	// Files whose content changed
+	Changed []string
+}
+
+// empty returns whether the event doesn't contain any changes
+func (e *ChangeEvent) empty() bool {
+	return len(e.Added) == 0 && len(e.Removed) == 0 && len(e.Changed) == 0
+}
+
+// defaultWatchInterval replaces intervals passed to Watch that aren't positive
+const defaultWatchInterval = time.Minute
+
+// Watch refreshes the metadata in the background every 'interval' (with some jitter) until 'ctx' is done. Whenever
+// files were added, removed or changed, an event is sent on the returned channel, which is closed once 'ctx' is done.
+// Failed refreshes are logged and retried on the next tick. Intervals that aren't positive are treated as one minute.
+func (m *Minirepo) Watch(ctx context.Context, interval time.Duration) <-chan ChangeEvent {
+	events := make(chan ChangeEvent)
+	go func() {
+		defer close(events)
+		m.WatchFunc(ctx, interval, func(event ChangeEvent) {
+			select {
+			case events <- event:
+			case <-ctx.Done():
+			}
+		})
+	}()
+	return events
+}
+
+// WatchFunc is like Watch, but calls 'callback' for every change instead of using a channel. It blocks until 'ctx' is
+// done.
+func (m *Minirepo) WatchFunc(ctx context.Context, interval time.Duration, callback func(ChangeEvent)) {
+	if interval <= 0 {
+		interval = defaultWatchInterval
+	}
+	// The metadata might also be replaced outside of the refreshes here, e.g. by calling TryUpdate or by another
+	// process sharing the cache, so compare against the metadata seen last instead of the result of the refresh
+	last := m.currentMeta()
+	for {
+		// Spread the refreshes of many clients by randomizing the interval by up to 10%
+		jitter := time.Duration((rand.Float64()*0.2 - 0.1) * float64(interval))
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval + jitter):
+		}
+
+		_, err := m.TryUpdateContext(ctx)
+		if err != nil {
+			m.logger.WithError(err).Warn("Refreshing metadata failed")
+			continue
+		}
+		current := m.currentMeta()
+		if current == last {
+			continue
+		}
+		event := diffMeta(last, current)
+		last = current
+		if !event.empty() {
+			callback(event)
+		}
+	}
+}
+
+// diffMeta compares the files contained in 'oldMeta' and 'newMeta'. 'oldMeta' may be nil.
+func diffMeta(oldMeta, newMeta *types.RepoInfo) ChangeEvent {
+	oldFiles := flattenMeta(oldMeta)
+	newFiles := flattenMeta(newMeta)
+	event := ChangeEvent{}
+	for file, hash := range newFiles {
+		oldHash, ok := oldFiles[file]
+		if !ok {
+			event.Added = append(event.Added, file)
+		} else if oldHash != hash {
+			event.Changed = append(event.Changed, file)
+		}
+	}
+	for file := range oldFiles {
+		if _, ok := newFiles[file]; !ok {
+			event.Removed = append(event.Removed, file)
+		}
+	}
+	sort.Strings(event.Added)
+	sort.Strings(event.Removed)
+	sort.Strings(event.Changed)
+	return event
+}
+
+// flattenMeta returns the hashes of all files contained in 'meta', keyed by their path
+func flattenMeta(meta *types.RepoInfo) map[string]string {
+	files := make(map[string]string)
+	if meta == nil {
+		return files
+	}
+	var walk func(prefix string, entries []types.DirEntry)
+	walk = func(prefix string, entries []types.DirEntry) {
+		for _, entry := range entries {
+			if entry.Hash != "" {
+				files[prefix+entry.Name] = entry.Hash
+			} else {
+				walk(prefix+entry.Name+"/", entry.Children)
+			}
+		}
+	}
+	walk("", meta.Contents)
+	return files
+}
@@ -0,0 +1,89 @@
+/*
+ * Copyright 2018 The minirepo authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import "errors"
+
+var (
+	// ErrNoKeys is returned when metadata should be signed before a keypair was loaded
+	ErrNoKeys = errors.New("no keypair loaded")
+	// ErrKeyNotFound is wrapped in a KeyError if a key file does not exist
+	ErrKeyNotFound = errors.New("key file not found")
+	// ErrRotationInProgress is returned when a key rotation should be started while another one is in progress
+	ErrRotationInProgress = errors.New("key rotation already in progress")
+	// ErrNoRotation is returned when a key rotation should be finished without starting it first
+	ErrNoRotation = errors.New("no key rotation in progress")
+	// ErrAlreadySigned is returned when a signature should be added to metadata that was already signed by the key
+	ErrAlreadySigned = errors.New("metadata already signed by this key")
+	// ErrPassphraseRequired is wrapped in a KeyError if a private key is encrypted, but no passphrase was set
+	ErrPassphraseRequired = errors.New("private key is encrypted, passphrase required")
+	// ErrWrongPassphrase is wrapped in a KeyError if a private key couldn't be decrypted using the passphrase
+	ErrWrongPassphrase = errors.New("private key decryption failed")
+	// ErrNoSigningKey is wrapped in a KeyError if a private key file doesn't contain a key that may be used for signing
+	ErrNoSigningKey = errors.New("no valid signing key found")
+	// ErrUnknownKeyAlgorithm is returned if a key algorithm isn't one of KeyAlgorithms
+	ErrUnknownKeyAlgorithm = errors.New("unknown key algorithm")
+)
+
+// KeyError is returned if key material couldn't be created, written, read or parsed
+type KeyError struct {
+	// File containing the key material
+	File string
+	// Underlying error
+	Err error
+}
+
+func (e *KeyError) Error() string {
+	return "key file " + e.File + ": " + e.Err.Error()
+}
+
+// Unwrap returns the underlying error
+func (e *KeyError) Unwrap() error {
+	return e.Err
+}
+
+// FileError is returned if a file or directory inside the repository couldn't be read or written
+type FileError struct {
+	// Path of the file or directory
+	Path string
+	// Underlying error
+	Err error
+}
+
+func (e *FileError) Error() string {
+	return "file " + e.Path + ": " + e.Err.Error()
+}
+
+// Unwrap returns the underlying error
+func (e *FileError) Unwrap() error {
+	return e.Err
+}
+
+// SignError is returned if the repository metadata couldn't be signed
+type SignError struct {
+	// Underlying error
+	Err error
+}
+
+func (e *SignError) Error() string {
+	return "signing failed: " + e.Err.Error()
+}
+
+// Unwrap returns the underlying error
+func (e *SignError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,114 @@
+/*
+ * Copyright 2018 The minirepo authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"path"
+)
+
+// hashCacheEntry contains the hash of a single file together with the attributes used to detect changes to it
+type hashCacheEntry struct {
+	// Size of the file in bytes
+	Size int64
+	// Modification time in nanoseconds since the epoch
+	MTime int64
+	// Inode number, 0 if not supported by the platform
+	Inode uint64
+	// SHA-256 hash of the file in Hex encoding
+	Hash string
+}
+
+// hashCache persists file hashes between metadata updates so that unchanged files don't need to be hashed again.
+// Entries are keyed by the path of the file relative to the repository root.
+type hashCache struct {
+	// File the cache is persisted to
+	file string
+	// Entries loaded from disk
+	old map[string]hashCacheEntry
+	// Entries seen during this run. Only these are persisted.
+	current map[string]hashCacheEntry
+	// Number of successful lookups during this run
+	hits int
+}
+
+// loadHashCache loads the hash cache from 'file'. If 'empty' is set or the file doesn't exist, an empty cache is
+// returned.
+func loadHashCache(file string, empty bool) (*hashCache, error) {
+	cache := &hashCache{
+		file:    file,
+		old:     make(map[string]hashCacheEntry),
+		current: make(map[string]hashCacheEntry),
+	}
+	if empty {
+		return cache, nil
+	}
+	cacheYAML, err := ioutil.ReadFile(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return cache, nil
+		}
+		return nil, &FileError{Path: file, Err: err}
+	}
+	err = yaml.Unmarshal(cacheYAML, &cache.old)
+	if err != nil {
+		return nil, &FileError{Path: file, Err: err}
+	}
+	return cache, nil
+}
+
+// newHashCacheEntry creates a cache entry for a file with attributes 'info' and hash 'hash'
+func newHashCacheEntry(info os.FileInfo, hash string) hashCacheEntry {
+	return hashCacheEntry{
+		Size:  info.Size(),
+		MTime: info.ModTime().UnixNano(),
+		Inode: inode(info),
+		Hash:  hash,
+	}
+}
+
+// lookup returns the cached hash of file 'name' if its attributes didn't change since it was hashed
+func (c *hashCache) lookup(name string, info os.FileInfo) (string, bool) {
+	entry, ok := c.old[name]
+	if !ok || entry != newHashCacheEntry(info, entry.Hash) {
+		return "", false
+	}
+	c.current[name] = entry
+	c.hits++
+	return entry.Hash, true
+}
+
+// store records the hash of file 'name'
+func (c *hashCache) store(name string, info os.FileInfo, hash string) {
+	c.current[name] = newHashCacheEntry(info, hash)
+}
+
+// save writes all entries recorded during this run to disk, dropping files that don't exist anymore
+func (c *hashCache) save() error {
+	cacheYAML, err := yaml.Marshal(c.current)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(c.file, cacheYAML, 0600)
+}
+
+// hashCacheFile returns the location of the hash cache below the server root 'root'
+func hashCacheFile(root string) string {
+	return path.Join(root, "hashcache.yml")
+}
@@ -0,0 +1,119 @@
+/*
+ * Copyright 2018 The minirepo authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"fmt"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/packet"
+	"golang.org/x/crypto/openpgp/s2k"
+	"strings"
+)
+
+// KeyAlgorithm selects the type of keys created by GenerateKeypair
+type KeyAlgorithm string
+
+const (
+	// KeyRSA3072 creates 3072-bit RSA keys
+	KeyRSA3072 KeyAlgorithm = "rsa3072"
+	// KeyRSA4096 creates 4096-bit RSA keys
+	KeyRSA4096 KeyAlgorithm = "rsa4096"
+	// KeyECDSAP256 creates ECDSA keys on the NIST P-256 curve
+	KeyECDSAP256 KeyAlgorithm = "p256"
+	// KeyECDSAP384 creates ECDSA keys on the NIST P-384 curve
+	KeyECDSAP384 KeyAlgorithm = "p384"
+
+	// DefaultKeyAlgorithm is used if no other algorithm was set
+	DefaultKeyAlgorithm = KeyRSA3072
+)
+
+// KeyAlgorithms lists all algorithms supported by GenerateKeypair.
+// Ed25519 is missing on purpose: golang.org/x/crypto/openpgp, which clients use to verify the metadata, can't parse
+// EdDSA keys.
+var KeyAlgorithms = []KeyAlgorithm{KeyRSA3072, KeyRSA4096, KeyECDSAP256, KeyECDSAP384}
+
+// ParseKeyAlgorithm returns the algorithm called 'name'
+func ParseKeyAlgorithm(name string) (KeyAlgorithm, error) {
+	for _, algo := range KeyAlgorithms {
+		if strings.EqualFold(name, string(algo)) {
+			return algo, nil
+		}
+	}
+	return "", fmt.Errorf("%w: %s", ErrUnknownKeyAlgorithm, name)
+}
+
+// newEntity creates a new entity for signing using 'algo'. RSA entities also contain an encryption subkey, like those
+// created by openpgp.NewEntity, while ECDSA entities only consist of the primary key.
+func newEntity(name, comment string, algo KeyAlgorithm, cfg *packet.Config) (*openpgp.Entity, error) {
+	var curve elliptic.Curve
+	switch algo {
+	case KeyRSA3072:
+		cfg.RSABits = 3072
+		return openpgp.NewEntity(name, comment, "", cfg)
+	case KeyRSA4096:
+		cfg.RSABits = 4096
+		return openpgp.NewEntity(name, comment, "", cfg)
+	case KeyECDSAP256:
+		curve = elliptic.P256()
+	case KeyECDSAP384:
+		curve = elliptic.P384()
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnknownKeyAlgorithm, algo)
+	}
+
+	uid := packet.NewUserId(name, comment, "")
+	if uid == nil {
+		return nil, fmt.Errorf("invalid user id %q", name)
+	}
+	privkey, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	creationTime := cfg.Now()
+	entity := &openpgp.Entity{
+		PrimaryKey: packet.NewECDSAPublicKey(creationTime, &privkey.PublicKey),
+		PrivateKey: packet.NewECDSAPrivateKey(creationTime, privkey),
+		Identities: make(map[string]*openpgp.Identity),
+	}
+	isPrimaryId := true
+	hid, _ := s2k.HashToHashId(cfg.Hash())
+	entity.Identities[uid.Id] = &openpgp.Identity{
+		Name:   uid.Id,
+		UserId: uid,
+		SelfSignature: &packet.Signature{
+			CreationTime:       creationTime,
+			SigType:            packet.SigTypePositiveCert,
+			PubKeyAlgo:         packet.PubKeyAlgoECDSA,
+			Hash:               cfg.Hash(),
+			IsPrimaryId:        &isPrimaryId,
+			FlagsValid:         true,
+			FlagSign:           true,
+			FlagCertify:        true,
+			IssuerKeyId:        &entity.PrimaryKey.KeyId,
+			PreferredHash:      []uint8{hid},
+			PreferredSymmetric: []uint8{uint8(cfg.Cipher())},
+		},
+	}
+	err = entity.Identities[uid.Id].SelfSignature.SignUserId(uid.Id, entity.PrimaryKey, entity.PrivateKey, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return entity, nil
+}
@@ -0,0 +1,50 @@
+/*
+ * Copyright 2018 The minirepo authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// PassphraseFunc returns the passphrase protecting the private keys. It is called at most once per Server, and only if
+// a passphrase is actually needed.
+type PassphraseFunc func() ([]byte, error)
+
+// PassphraseFromEnv returns a PassphraseFunc reading the passphrase from the environment variable 'name'
+func PassphraseFromEnv(name string) PassphraseFunc {
+	return func() ([]byte, error) {
+		passphrase, ok := os.LookupEnv(name)
+		if !ok {
+			return nil, errors.New("environment variable " + name + " not set")
+		}
+		return []byte(passphrase), nil
+	}
+}
+
+// PassphraseFromFile returns a PassphraseFunc reading the passphrase from 'file'. A trailing line break is removed.
+func PassphraseFromFile(file string) PassphraseFunc {
+	return func() ([]byte, error) {
+		passphrase, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(strings.TrimRight(string(passphrase), "\r\n")), nil
+	}
+}
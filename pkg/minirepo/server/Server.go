@@ -0,0 +1,617 @@
+/*
+ * Copyright 2018 The minirepo authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package server provides the functionality needed for creating and signing minirepo repositories
+package server
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"github.com/uubk/minirepo/pkg/minirepo/types"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/openpgp/packet"
+	"gopkg.in/yaml.v2"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// Server contains the functionality of minirepo's commandline interface
+// A Server abstracts the metadata file creation of a repository, including cryptographic operations.
+// The normal usage of this class would be:
+//
+//	obj := NewServer(...)
+//	err := obj.LoadKeypair()
+//	...
+//	stats, err := obj.UpdateMetadata()
+//
+//
+type Server struct {
+	// Server root. This is where the key material will be stored
+	root string
+	// Repo root. This is where the files are expected to be
+	repo string
+	// Server name. This is encoded into the repository key and manifest
+	name string
+
+	// Entity used to sign files
+	entity *openpgp.Entity
+	// Entity of the key that replaces 'entity', if a key rotation is in progress
+	nextEntity *openpgp.Entity
+	// ASCII-armored public key of 'nextEntity'
+	nextPubkey string
+	// Whether to ignore the hash cache
+	forceRehash bool
+	// Number of files to hash concurrently
+	jobs int
+	// Validity period of the metadata, 0 if it doesn't expire
+	validity time.Duration
+	// Algorithm of newly generated keys
+	keyAlgorithm KeyAlgorithm
+	// Source of the passphrase protecting the private keys, nil if they are stored unencrypted
+	passphraseFunc PassphraseFunc
+	// Passphrase returned by passphraseFunc, once it was called
+	passphrase []byte
+}
+
+// UpdateStats contains statistics about a metadata update
+type UpdateStats struct {
+	// Number of files that were hashed
+	Hashed int
+	// Number of files whose hash was taken from the hash cache
+	Reused int
+}
+
+// NewServer creates a new minirepo server utility class
+func NewServer(root, repo, name string) *Server {
+	return &Server{
+		root:         root,
+		repo:         repo,
+		name:         name,
+		jobs:         runtime.NumCPU(),
+		keyAlgorithm: DefaultKeyAlgorithm,
+	}
+}
+
+// SetForceRehash decides whether the hash cache is ignored, forcing all files to be hashed again on the next update
+func (s *Server) SetForceRehash(force bool) {
+	s.forceRehash = force
+}
+
+// SetJobs sets the number of files that are hashed concurrently. Values smaller than 1 are treated as 1.
+func (s *Server) SetJobs(jobs int) {
+	if jobs < 1 {
+		jobs = 1
+	}
+	s.jobs = jobs
+}
+
+// SetValidity sets the time after which clients should consider newly created metadata stale. A duration of 0 (the
+// default) creates metadata that never expires.
+func (s *Server) SetValidity(validity time.Duration) {
+	s.validity = validity
+}
+
+// Names of the key files in the server root
+const (
+	pubkeyName      = "pub.asc"
+	privkeyName     = "priv.asc"
+	nextPubkeyName  = "next-pub.asc"
+	nextPrivkeyName = "next-priv.asc"
+	oldPubkeyName   = "old-pub.asc"
+	oldPrivkeyName  = "old-priv.asc"
+)
+
+// SetKeyAlgorithm sets the algorithm of keys created by GenerateKeypair and StartKeyRotation. Existing keys are loaded
+// regardless of their algorithm.
+func (s *Server) SetKeyAlgorithm(algo KeyAlgorithm) {
+	s.keyAlgorithm = algo
+}
+
+// SetPassphrase sets where the passphrase protecting the private keys comes from. Keys generated afterwards are
+// encrypted using the passphrase, and encrypted keys can only be loaded with a passphrase.
+func (s *Server) SetPassphrase(passphraseFunc PassphraseFunc) {
+	s.passphraseFunc = passphraseFunc
+	s.passphrase = nil
+}
+
+// getPassphrase returns the passphrase protecting the private keys, nil if there is none
+func (s *Server) getPassphrase() ([]byte, error) {
+	if s.passphrase == nil && s.passphraseFunc != nil {
+		passphrase, err := s.passphraseFunc()
+		if err != nil {
+			return nil, err
+		}
+		s.passphrase = passphrase
+	}
+	return s.passphrase, nil
+}
+
+// LoadKeypair loads a keypair from files. If a key rotation is in progress, the next keypair is loaded as well.
+func (s *Server) LoadKeypair() error {
+	entity, err := s.loadKeypair(path.Join(s.root, pubkeyName), path.Join(s.root, privkeyName))
+	if err != nil {
+		return err
+	}
+	s.entity = entity
+	return s.loadNextKeypair()
+}
+
+// loadNextKeypair loads the keypair that replaces the current one, if a key rotation is in progress
+func (s *Server) loadNextKeypair() error {
+	nextPubkeyFile := path.Join(s.root, nextPubkeyName)
+	nextEntity, err := s.loadKeypair(nextPubkeyFile, path.Join(s.root, nextPrivkeyName))
+	if errors.Is(err, ErrKeyNotFound) {
+		s.nextEntity = nil
+		s.nextPubkey = ""
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	nextPubkey, err := ioutil.ReadFile(nextPubkeyFile)
+	if err != nil {
+		return &KeyError{File: nextPubkeyFile, Err: err}
+	}
+	s.nextEntity = nextEntity
+	s.nextPubkey = string(nextPubkey)
+	return nil
+}
+
+// loadKeypair loads the keypair stored in 'pubkeyFile' and 'privkeyFile', decrypting the private keys if necessary.
+// The private key file may contain a full entity, e.g. exported from GnuPG, in which case the right key for signing is
+// picked from its subkeys.
+func (s *Server) loadKeypair(pubkeyFile, privkeyFile string) (*openpgp.Entity, error) {
+	pubkey, err := loadKeyFromFile(pubkeyFile, true)
+	if err != nil {
+		return nil, err
+	}
+	entity, err := loadEntityFromFile(privkeyFile)
+	if err != nil {
+		// A bare key consists of a single packet, so otherwise the file is an invalid entity
+		count, countErr := countPackets(privkeyFile)
+		if countErr == nil && count > 1 {
+			return nil, &KeyError{File: privkeyFile, Err: err}
+		}
+		// Not a full entity, so this is just a bare key
+		privkey, err := loadKeyFromFile(privkeyFile, false)
+		if err != nil {
+			return nil, err
+		}
+		err = s.decryptKey(privkey.(*packet.PrivateKey))
+		if err != nil {
+			return nil, &KeyError{File: privkeyFile, Err: err}
+		}
+		return fakeEntity(pubkey.(*packet.PublicKey), privkey.(*packet.PrivateKey)), nil
+	}
+
+	if entity.PrimaryKey.Fingerprint != pubkey.(*packet.PublicKey).Fingerprint {
+		return nil, &KeyError{File: privkeyFile, Err: errors.New("private key doesn't match " + pubkeyFile)}
+	}
+	err = s.decryptKey(entity.PrivateKey)
+	if err != nil {
+		return nil, &KeyError{File: privkeyFile, Err: err}
+	}
+	for _, subkey := range entity.Subkeys {
+		if subkey.PrivateKey != nil {
+			err = s.decryptKey(subkey.PrivateKey)
+			if err != nil {
+				return nil, &KeyError{File: privkeyFile, Err: err}
+			}
+		}
+	}
+	signer, err := signingEntity(entity, time.Now())
+	if err != nil {
+		return nil, &KeyError{File: privkeyFile, Err: err}
+	}
+	return signer, nil
+}
+
+// decryptKey decrypts 'privkey' using the passphrase, if it is encrypted
+func (s *Server) decryptKey(privkey *packet.PrivateKey) error {
+	if !privkey.Encrypted {
+		return nil
+	}
+	passphrase, err := s.getPassphrase()
+	if err != nil {
+		return err
+	}
+	if passphrase == nil {
+		return ErrPassphraseRequired
+	}
+	err = privkey.Decrypt(passphrase)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrWrongPassphrase, err)
+	}
+	return nil
+}
+
+// GenerateKeypair generates a new keypair for signing
+func (s *Server) GenerateKeypair() error {
+	return s.generateKeypair(path.Join(s.root, pubkeyName), path.Join(s.root, privkeyName))
+}
+
+// StartKeyRotation generates the keypair that replaces the current one. Until the rotation is finished, metadata is
+// signed by both keys and announces the new key, so that clients trusting the current key can adopt the new one.
+func (s *Server) StartKeyRotation() error {
+	nextPubkeyFile := path.Join(s.root, nextPubkeyName)
+	_, err := os.Stat(nextPubkeyFile)
+	if err == nil {
+		return ErrRotationInProgress
+	}
+	err = s.generateKeypair(nextPubkeyFile, path.Join(s.root, nextPrivkeyName))
+	if err != nil {
+		return err
+	}
+	return s.loadNextKeypair()
+}
+
+// FinishKeyRotation replaces the current keypair with the one generated by StartKeyRotation. The replaced keypair is
+// kept in old-pub.asc and old-priv.asc. Clients that didn't fetch metadata during the rotation need to be
+// reconfigured with the new key.
+func (s *Server) FinishKeyRotation() error {
+	if s.nextEntity == nil {
+		return ErrNoRotation
+	}
+	for _, rename := range [][2]string{{pubkeyName, oldPubkeyName}, {privkeyName, oldPrivkeyName},
+		{nextPubkeyName, pubkeyName}, {nextPrivkeyName, privkeyName}} {
+		err := os.Rename(path.Join(s.root, rename[0]), path.Join(s.root, rename[1]))
+		if err != nil {
+			return &KeyError{File: path.Join(s.root, rename[0]), Err: err}
+		}
+	}
+	s.entity = s.nextEntity
+	s.nextEntity = nil
+	s.nextPubkey = ""
+	return nil
+}
+
+// generateKeypair generates a new keypair for signing and stores it in 'pubkeyFile' and 'privkeyFile'
+func (s *Server) generateKeypair(pubkeyFile, privkeyFile string) error {
+	cfg := packet.Config{
+		DefaultCipher:          packet.CipherAES128,
+		DefaultHash:            crypto.SHA384,
+		DefaultCompressionAlgo: packet.CompressionNone,
+	}
+	// Generate key
+	entity, err := newEntity(s.name, "Autogenerated", s.keyAlgorithm, &cfg)
+	if err != nil {
+		return &KeyError{File: privkeyFile, Err: err}
+	}
+
+	// Write public key
+	err = writeArmored(pubkeyFile, openpgp.PublicKeyType, 0644, entity.Serialize)
+	if err != nil {
+		return &KeyError{File: pubkeyFile, Err: err}
+	}
+
+	// Write private key, encrypted if there is a passphrase
+	passphrase, err := s.getPassphrase()
+	if err != nil {
+		return &KeyError{File: privkeyFile, Err: err}
+	}
+	err = writeArmored(privkeyFile, openpgp.PrivateKeyType, 0600, func(out io.Writer) error {
+		if passphrase != nil {
+			return serializePrivateEncrypted(out, entity, passphrase, &cfg)
+		}
+		return entity.SerializePrivate(out, &cfg)
+	})
+	if err != nil {
+		return &KeyError{File: privkeyFile, Err: err}
+	}
+	return nil
+}
+
+// writeArmored creates or truncates 'file' and writes the output of 'serialize' into it using ASCII armor of type
+// 'blockType'
+func writeArmored(file, blockType string, mode os.FileMode, serialize func(io.Writer) error) error {
+	fd, err := os.OpenFile(file, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	out, err := armor.Encode(fd, blockType, nil)
+	if err != nil {
+		return err
+	}
+	err = serialize(out)
+	if err != nil {
+		return err
+	}
+	err = out.Close()
+	if err != nil {
+		return err
+	}
+	return fd.Close()
+}
+
+// hashJob describes a file that needs to be hashed
+type hashJob struct {
+	// Full path of the file
+	file string
+	// Path of the file relative to the repository root
+	relFile string
+	// File attributes, used for the hash cache
+	info os.FileInfo
+	// Index of the entry within its parent directory
+	index int
+	// Entry to store the hash in
+	entry *types.DirEntry
+}
+
+// readDir reads the directory 'dir', returing it's contents as a directory entry. 'relDir' is the path of 'dir'
+// relative to the repository root. Hashes of files which aren't in the hash cache are left empty, a job to calculate
+// them is appended to 'jobs' instead.
+func (s *Server) readDir(dir, relDir string, cache *hashCache, jobs *[]hashJob) (types.DirEntry, error) {
+	_, name := path.Split(dir)
+	myEntry := types.DirEntry{
+		Name: name,
+	}
+	// ReadDir returns entries sorted by name, which keeps the metadata deterministic
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return myEntry, &FileError{Path: dir, Err: err}
+	}
+	var pending []hashJob
+	for _, item := range files {
+		if item.IsDir() {
+			child, err := s.readDir(path.Join(dir, item.Name()), path.Join(relDir, item.Name()), cache, jobs)
+			if err != nil {
+				return myEntry, err
+			}
+			myEntry.Children = append(myEntry.Children, child)
+		} else {
+			relFile := path.Join(relDir, item.Name())
+			hashSum, ok := cache.lookup(relFile, item)
+			if !ok {
+				pending = append(pending, hashJob{
+					file:    path.Join(dir, item.Name()),
+					relFile: relFile,
+					info:    item,
+					index:   len(myEntry.Children),
+				})
+			}
+
+			size := item.Size()
+			myEntry.Children = append(myEntry.Children, types.DirEntry{
+				Name: item.Name(),
+				Hash: hashSum,
+				Size: &size,
+			})
+		}
+	}
+	// The list of children is final now, so pointers into it stay valid even if myEntry is copied
+	for _, job := range pending {
+		job.entry = &myEntry.Children[job.index]
+		*jobs = append(*jobs, job)
+	}
+
+	return myEntry, nil
+}
+
+// hashFiles runs all 'jobs' using a pool of s.jobs workers, storing the results in the hash cache
+func (s *Server) hashFiles(jobs []hashJob, cache *hashCache) error {
+	queue := make(chan *hashJob)
+	errs := make(chan error, len(jobs))
+	var wg sync.WaitGroup
+	for i := 0; i < s.jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range queue {
+				hashSum, err := hashFile(job.file)
+				if err != nil {
+					errs <- err
+					continue
+				}
+				job.entry.Hash = hashSum
+			}
+		}()
+	}
+	for i := range jobs {
+		queue <- &jobs[i]
+	}
+	close(queue)
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		return err
+	}
+	for _, job := range jobs {
+		cache.store(job.relFile, job.info, job.entry.Hash)
+	}
+	return nil
+}
+
+// hashFile calculates the SHA-256 hash of 'file', returning it in Hex encoding
+func hashFile(file string) (string, error) {
+	fd, err := os.Open(file)
+	if err != nil {
+		return "", &FileError{Path: file, Err: err}
+	}
+	defer fd.Close()
+	hash := sha256.New()
+	_, err = io.Copy(hash, fd)
+	if err != nil {
+		return "", &FileError{Path: file, Err: err}
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// UpdateMetadata updates metadata, that is, loads all files, calculates checksums, outputs the YAML file and signs it.
+// Checksums of files that didn't change since the last update are taken from the hash cache.
+func (s *Server) UpdateMetadata() (UpdateStats, error) {
+	stats := UpdateStats{}
+	if s.entity == nil {
+		return stats, ErrNoKeys
+	}
+	cache, err := loadHashCache(hashCacheFile(s.root), s.forceRehash)
+	if err != nil {
+		return stats, err
+	}
+
+	repoStruct := types.RepoInfo{
+		Name:      s.name,
+		Timestamp: time.Now(),
+	}
+	if s.validity > 0 {
+		expires := repoStruct.Timestamp.Add(s.validity)
+		repoStruct.Expires = &expires
+	}
+	if s.nextEntity != nil {
+		repoStruct.NextKeys = []types.AnnouncedKey{
+			{
+				Fingerprint: fmt.Sprintf("%X", s.nextEntity.PrimaryKey.Fingerprint),
+				Key:         s.nextPubkey,
+				Replaces:    fmt.Sprintf("%X", s.entity.PrimaryKey.Fingerprint),
+			},
+		}
+	}
+	files, err := ioutil.ReadDir(s.repo)
+	if err != nil {
+		return stats, &FileError{Path: s.repo, Err: err}
+	}
+	var jobs []hashJob
+	for _, item := range files {
+		if item.IsDir() && item.Name() == types.ReservedDir {
+			log.WithField("dir", item.Name()).Warn("Skipping directory reserved for client caches")
+			continue
+		}
+		if item.IsDir() {
+			child, err := s.readDir(path.Join(s.repo, item.Name()), item.Name(), cache, &jobs)
+			if err != nil {
+				return stats, err
+			}
+			repoStruct.Contents = append(repoStruct.Contents, child)
+		}
+		// Files in repo root are ignored
+	}
+	err = s.hashFiles(jobs, cache)
+	if err != nil {
+		return stats, err
+	}
+	stats.Hashed = len(jobs)
+	stats.Reused = cache.hits
+	err = cache.save()
+	if err != nil {
+		return stats, err
+	}
+
+	repoStructYAML, err := yaml.Marshal(repoStruct)
+	if err != nil {
+		return stats, err
+	}
+	log.Info("Signing metadata")
+	sigBin, err := s.signMetadata(repoStructYAML, nil)
+	if err != nil {
+		return stats, err
+	}
+	// Keep the current metadata and signature until both new files are ready
+	return stats, writeFilesAtomic([]string{path.Join(s.repo, "meta.asc"), path.Join(s.repo, "meta.yml")},
+		[][]byte{sigBin, repoStructYAML}, 0644)
+}
+
+// AddSignature signs the existing metadata in the repository without regenerating it, keeping the signatures that are
+// already present. This allows several signers to co-sign the same metadata.
+func (s *Server) AddSignature() error {
+	if s.entity == nil {
+		return ErrNoKeys
+	}
+	repoInfoFile := path.Join(s.repo, "meta.yml")
+	repoStructYAML, err := ioutil.ReadFile(repoInfoFile)
+	if err != nil {
+		return &FileError{Path: repoInfoFile, Err: err}
+	}
+	repoSigFile := path.Join(s.repo, "meta.asc")
+	sigFD, err := os.Open(repoSigFile)
+	if err != nil {
+		return &FileError{Path: repoSigFile, Err: err}
+	}
+	defer sigFD.Close()
+	block, err := armor.Decode(sigFD)
+	if err != nil {
+		return &FileError{Path: repoSigFile, Err: err}
+	}
+	existing, err := ioutil.ReadAll(block.Body)
+	if err != nil {
+		return &FileError{Path: repoSigFile, Err: err}
+	}
+
+	packets := packet.NewReader(bytes.NewReader(existing))
+	for {
+		p, err := packets.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return &FileError{Path: repoSigFile, Err: err}
+		}
+		sig, ok := p.(*packet.Signature)
+		if ok && sig.IssuerKeyId != nil && *sig.IssuerKeyId == signingKeyId(s.entity) {
+			return ErrAlreadySigned
+		}
+	}
+	sigFD.Close()
+
+	log.Info("Signing metadata")
+	sigBin, err := s.signMetadata(repoStructYAML, existing)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(repoSigFile, sigBin, 0644)
+}
+
+// signMetadata returns the signature file for 'repoStructYAML'. All signatures go into a single armored block,
+// starting with the binary signature packets in 'existing'. Clients skip signatures by keys they don't know. If a key
+// rotation is in progress, the metadata is signed by both keys.
+func (s *Server) signMetadata(repoStructYAML, existing []byte) ([]byte, error) {
+	signers := []*openpgp.Entity{s.entity}
+	if s.nextEntity != nil {
+		signers = append(signers, s.nextEntity)
+	}
+
+	sigBin := &bytes.Buffer{}
+	out, err := armor.Encode(sigBin, openpgp.SignatureType, nil)
+	if err != nil {
+		return nil, &SignError{Err: err}
+	}
+	_, err = out.Write(existing)
+	if err != nil {
+		return nil, &SignError{Err: err}
+	}
+	for _, signer := range signers {
+		err = openpgp.DetachSign(out, signer, bytes.NewReader(repoStructYAML), nil)
+		if err != nil {
+			return nil, &SignError{Err: err}
+		}
+	}
+	err = out.Close()
+	if err != nil {
+		return nil, &SignError{Err: err}
+	}
+	return sigBin.Bytes(), nil
+}
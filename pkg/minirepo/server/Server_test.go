@@ -0,0 +1,693 @@
+/*
+ * Copyright 2018 The minirepo authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"crypto/ecdsa"
+	"errors"
+	"fmt"
+	"github.com/uubk/minirepo/pkg/minirepo/types"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/packet"
+	"gopkg.in/yaml.v2"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func initTestServer(t *testing.T) *Server {
+	testPath, err := ioutil.TempDir("", "minirepo-unittest")
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	repoRoot := path.Join(testPath, "repo")
+	err = os.MkdirAll(path.Join(repoRoot, "a_dir"), 0700)
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	err = ioutil.WriteFile(path.Join(repoRoot, "a_dir", "testfile"), []byte("test"), 0600)
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	svc := NewServer(testPath, repoRoot, "Unittest Server")
+	// ECDSA keys are much faster to generate than the default RSA keys
+	svc.SetKeyAlgorithm(KeyECDSAP256)
+	return svc
+}
+
+func TestErrors(t *testing.T) {
+	svc := initTestServer(t)
+
+	_, err := svc.UpdateMetadata()
+	if err != ErrNoKeys {
+		t.Fatal("Unexpected error: ", err)
+	}
+
+	err = svc.LoadKeypair()
+	if !errors.Is(err, ErrKeyNotFound) {
+		t.Fatal("Unexpected error: ", err)
+	}
+	var keyErr *KeyError
+	if !errors.As(err, &keyErr) || keyErr.File != path.Join(svc.root, "pub.asc") {
+		t.Fatal("Unexpected error: ", err)
+	}
+
+	err = svc.GenerateKeypair()
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	err = svc.LoadKeypair()
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+
+	svc.repo = path.Join(svc.root, "missing")
+	_, err = svc.UpdateMetadata()
+	var fileErr *FileError
+	if !errors.As(err, &fileErr) || fileErr.Path != svc.repo {
+		t.Fatal("Unexpected error: ", err)
+	}
+}
+
+func TestReservedDir(t *testing.T) {
+	svc := initTestServer(t)
+	err := os.MkdirAll(path.Join(svc.repo, types.ReservedDir, "locks"), 0700)
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	err = ioutil.WriteFile(path.Join(svc.repo, types.ReservedDir, "locks", "file"), []byte("test"), 0600)
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	err = svc.GenerateKeypair()
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	err = svc.LoadKeypair()
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	_, err = svc.UpdateMetadata()
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+
+	metaBin, err := ioutil.ReadFile(path.Join(svc.repo, "meta.yml"))
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	meta := &types.RepoInfo{}
+	err = yaml.Unmarshal(metaBin, meta)
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	if len(meta.Contents) != 1 || meta.Contents[0].Name != "a_dir" {
+		t.Fatal("Unexpected contents: ", meta.Contents)
+	}
+}
+
+func TestHashCache(t *testing.T) {
+	svc := initTestServer(t)
+	err := svc.GenerateKeypair()
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	err = svc.LoadKeypair()
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+
+	stats, err := svc.UpdateMetadata()
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	if stats.Hashed != 1 || stats.Reused != 0 {
+		t.Fatal("Unexpected stats on first run: ", stats)
+	}
+
+	stats, err = svc.UpdateMetadata()
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	if stats.Hashed != 0 || stats.Reused != 1 {
+		t.Fatal("Unexpected stats on second run: ", stats)
+	}
+
+	err = ioutil.WriteFile(path.Join(svc.repo, "a_dir", "testfile"), []byte("changed"), 0600)
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	stats, err = svc.UpdateMetadata()
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	if stats.Hashed != 1 || stats.Reused != 0 {
+		t.Fatal("Unexpected stats after change: ", stats)
+	}
+
+	svc.SetForceRehash(true)
+	stats, err = svc.UpdateMetadata()
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	if stats.Hashed != 1 || stats.Reused != 0 {
+		t.Fatal("Unexpected stats with forced rehash: ", stats)
+	}
+}
+
+func TestParallelHashing(t *testing.T) {
+	svc := initTestServer(t)
+	err := svc.GenerateKeypair()
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	err = svc.LoadKeypair()
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	for _, dir := range []string{"b_dir", "c_dir/sub", "c_dir/sub2"} {
+		err = os.MkdirAll(path.Join(svc.repo, dir), 0700)
+		if err != nil {
+			t.Fatal("Unexpected error: ", err)
+		}
+		for _, file := range []string{"z", "a", "m"} {
+			err = ioutil.WriteFile(path.Join(svc.repo, dir, file), []byte(dir+file), 0600)
+			if err != nil {
+				t.Fatal("Unexpected error: ", err)
+			}
+		}
+	}
+
+	readMeta := func(jobs int) string {
+		svc.SetJobs(jobs)
+		svc.SetForceRehash(true)
+		stats, err := svc.UpdateMetadata()
+		if err != nil {
+			t.Fatal("Unexpected error: ", err)
+		}
+		if stats.Hashed != 10 {
+			t.Fatal("Unexpected stats: ", stats)
+		}
+		meta, err := ioutil.ReadFile(path.Join(svc.repo, "meta.yml"))
+		if err != nil {
+			t.Fatal("Unexpected error: ", err)
+		}
+		// Strip timestamp
+		return strings.Split(string(meta), "timestamp:")[0]
+	}
+
+	serial := readMeta(1)
+	for i := 0; i < 5; i++ {
+		if parallel := readMeta(8); parallel != serial {
+			t.Fatalf("Metadata differs:\n%s\n%s", serial, parallel)
+		}
+	}
+}
+
+// checkSignature verifies the metadata signature in 'svc' against the public key in 'pubkeyFile'
+func checkSignature(svc *Server, pubkeyFile string) error {
+	pubkey, err := os.Open(path.Join(svc.root, pubkeyFile))
+	if err != nil {
+		return err
+	}
+	defer pubkey.Close()
+	keyring, err := openpgp.ReadArmoredKeyRing(pubkey)
+	if err != nil {
+		return err
+	}
+	metaYml, err := os.Open(path.Join(svc.repo, "meta.yml"))
+	if err != nil {
+		return err
+	}
+	defer metaYml.Close()
+	metaAsc, err := os.Open(path.Join(svc.repo, "meta.asc"))
+	if err != nil {
+		return err
+	}
+	defer metaAsc.Close()
+	_, err = openpgp.CheckArmoredDetachedSignature(keyring, metaYml, metaAsc)
+	return err
+}
+
+func TestUpdateMetadataFailure(t *testing.T) {
+	svc := initTestServer(t)
+	err := svc.GenerateKeypair()
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	err = svc.LoadKeypair()
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	_, err = svc.UpdateMetadata()
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	metaBin, err := ioutil.ReadFile(path.Join(svc.repo, "meta.yml"))
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	err = ioutil.WriteFile(path.Join(svc.repo, "a_dir", "new"), []byte("new"), 0600)
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+
+	// Neither a failed signature nor a failed write replaces the current metadata
+	svc.entity.PrivateKey.Encrypted = true
+	_, err = svc.UpdateMetadata()
+	var signErr *SignError
+	if !errors.As(err, &signErr) {
+		t.Fatal("Expected SignError, got ", err)
+	}
+	svc.entity.PrivateKey.Encrypted = false
+	err = os.Mkdir(path.Join(svc.repo, "meta.yml.tmp"), 0700)
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	_, err = svc.UpdateMetadata()
+	var fileErr *FileError
+	if !errors.As(err, &fileErr) {
+		t.Fatal("Expected FileError, got ", err)
+	}
+	os.Remove(path.Join(svc.repo, "meta.yml.tmp"))
+
+	newMetaBin, err := ioutil.ReadFile(path.Join(svc.repo, "meta.yml"))
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	if string(newMetaBin) != string(metaBin) {
+		t.Fatal("Metadata shouldn't have changed")
+	}
+	err = checkSignature(svc, "pub.asc")
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	_, err = os.Stat(path.Join(svc.repo, "meta.asc.tmp"))
+	if !os.IsNotExist(err) {
+		t.Fatal("Temporary signature file should have been removed: ", err)
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	svc := initTestServer(t)
+	err := svc.GenerateKeypair()
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	err = svc.LoadKeypair()
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	err = svc.FinishKeyRotation()
+	if err != ErrNoRotation {
+		t.Fatal("Expected ErrNoRotation, got ", err)
+	}
+
+	err = svc.StartKeyRotation()
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	err = svc.StartKeyRotation()
+	if err != ErrRotationInProgress {
+		t.Fatal("Expected ErrRotationInProgress, got ", err)
+	}
+	// A fresh server picks up the rotation in progress
+	svc = NewServer(svc.root, svc.repo, svc.name)
+	err = svc.LoadKeypair()
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	_, err = svc.UpdateMetadata()
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	for _, pubkeyFile := range []string{"pub.asc", "next-pub.asc"} {
+		err = checkSignature(svc, pubkeyFile)
+		if err != nil {
+			t.Fatal("Signature by ", pubkeyFile, " invalid: ", err)
+		}
+	}
+	metaBin, err := ioutil.ReadFile(path.Join(svc.repo, "meta.yml"))
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	meta := types.RepoInfo{}
+	err = yaml.Unmarshal(metaBin, &meta)
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	nextPubkey, err := ioutil.ReadFile(path.Join(svc.root, "next-pub.asc"))
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	if len(meta.NextKeys) != 1 || meta.NextKeys[0].Key != string(nextPubkey) ||
+		meta.NextKeys[0].Fingerprint != fmt.Sprintf("%X", svc.nextEntity.PrimaryKey.Fingerprint) ||
+		meta.NextKeys[0].Replaces != fmt.Sprintf("%X", svc.entity.PrimaryKey.Fingerprint) {
+		t.Fatal("Unexpected announced keys: ", meta.NextKeys)
+	}
+
+	err = svc.FinishKeyRotation()
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	_, err = svc.UpdateMetadata()
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	err = checkSignature(svc, "pub.asc")
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	err = checkSignature(svc, "old-pub.asc")
+	if err == nil {
+		t.Fatal("Metadata still signed by old key")
+	}
+	_, err = os.Stat(path.Join(svc.root, "next-pub.asc"))
+	if !os.IsNotExist(err) {
+		t.Fatal("Next key should have been promoted")
+	}
+}
+
+func TestAddSignature(t *testing.T) {
+	svc := initTestServer(t)
+	err := svc.AddSignature()
+	if err != ErrNoKeys {
+		t.Fatal("Expected ErrNoKeys, got ", err)
+	}
+	err = svc.GenerateKeypair()
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	err = svc.LoadKeypair()
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	_, err = svc.UpdateMetadata()
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	metaBin, err := ioutil.ReadFile(path.Join(svc.repo, "meta.yml"))
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+
+	// A co-signer with its own key but the same repository
+	coRoot, err := ioutil.TempDir("", "minirepo-unittest")
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	coSigner := NewServer(coRoot, svc.repo, "Co-Signer")
+	coSigner.SetKeyAlgorithm(KeyECDSAP256)
+	err = coSigner.GenerateKeypair()
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	err = coSigner.LoadKeypair()
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	err = coSigner.AddSignature()
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	err = coSigner.AddSignature()
+	if err != ErrAlreadySigned {
+		t.Fatal("Expected ErrAlreadySigned, got ", err)
+	}
+
+	newMetaBin, err := ioutil.ReadFile(path.Join(svc.repo, "meta.yml"))
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	if string(newMetaBin) != string(metaBin) {
+		t.Fatal("Metadata shouldn't have changed")
+	}
+
+	// A signer failing to write the signature file doesn't lose the existing signatures
+	failRoot, err := ioutil.TempDir("", "minirepo-unittest")
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	failSigner := NewServer(failRoot, svc.repo, "Failing Signer")
+	failSigner.SetKeyAlgorithm(KeyECDSAP256)
+	err = failSigner.GenerateKeypair()
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	err = failSigner.LoadKeypair()
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	err = os.Mkdir(path.Join(svc.repo, "meta.asc.tmp"), 0700)
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	err = failSigner.AddSignature()
+	if err == nil {
+		t.Fatal("Expected an error")
+	}
+	os.Remove(path.Join(svc.repo, "meta.asc.tmp"))
+
+	err = checkSignature(svc, "pub.asc")
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	err = checkSignature(coSigner, "pub.asc")
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+}
+
+func TestEncryptedKeys(t *testing.T) {
+	svc := initTestServer(t)
+	os.Setenv("MINIREPO_TEST_PASSPHRASE", "secret")
+	defer os.Unsetenv("MINIREPO_TEST_PASSPHRASE")
+	svc.SetPassphrase(PassphraseFromEnv("MINIREPO_TEST_PASSPHRASE"))
+	err := svc.GenerateKeypair()
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	privkey, err := loadKeyFromFile(path.Join(svc.root, "priv.asc"), false)
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	if !privkey.(*packet.PrivateKey).Encrypted {
+		t.Fatal("Private key should be encrypted")
+	}
+
+	svc = NewServer(svc.root, svc.repo, svc.name)
+	err = svc.LoadKeypair()
+	if !errors.Is(err, ErrPassphraseRequired) {
+		t.Fatal("Expected ErrPassphraseRequired, got ", err)
+	}
+	passphraseFile := path.Join(svc.root, "passphrase")
+	err = ioutil.WriteFile(passphraseFile, []byte("wrong\n"), 0600)
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	svc.SetPassphrase(PassphraseFromFile(passphraseFile))
+	err = svc.LoadKeypair()
+	if !errors.Is(err, ErrWrongPassphrase) {
+		t.Fatal("Expected ErrWrongPassphrase, got ", err)
+	}
+	err = ioutil.WriteFile(passphraseFile, []byte("secret\n"), 0600)
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	svc.SetPassphrase(PassphraseFromFile(passphraseFile))
+	err = svc.LoadKeypair()
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	_, err = svc.UpdateMetadata()
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	err = checkSignature(svc, "pub.asc")
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+}
+
+func TestImportEntity(t *testing.T) {
+	svc := initTestServer(t)
+
+	// Exported from GnuPG: a real user ID, the primary key only certifies and a subkey signs. The passphrase is
+	// 'secret'.
+	for _, file := range [][2]string{{"gnupg-pub.asc", "pub.asc"}, {"gnupg-priv.asc", "priv.asc"}} {
+		keyBin, err := ioutil.ReadFile(path.Join("testdata", file[0]))
+		if err != nil {
+			t.Fatal("Unexpected error: ", err)
+		}
+		err = ioutil.WriteFile(path.Join(svc.root, file[1]), keyBin, 0600)
+		if err != nil {
+			t.Fatal("Unexpected error: ", err)
+		}
+	}
+	svc.SetPassphrase(func() ([]byte, error) {
+		return []byte("secret"), nil
+	})
+
+	err := svc.LoadKeypair()
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	if _, ok := svc.entity.Identities["Release Key <release@example.com>"]; !ok {
+		t.Fatal("Identity missing: ", svc.entity.Identities)
+	}
+	if signingKeyId(svc.entity) != svc.entity.Subkeys[0].PublicKey.KeyId {
+		t.Fatal("Signing subkey not selected")
+	}
+	_, err = svc.UpdateMetadata()
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	err = checkSignature(svc, "pub.asc")
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+
+	// The public key has to match
+	otherEntity, err := openpgp.NewEntity("Other", "", "", nil)
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	err = writeArmored(path.Join(svc.root, "pub.asc"), openpgp.PublicKeyType, 0644, otherEntity.Serialize)
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	err = svc.LoadKeypair()
+	var keyErr *KeyError
+	if !errors.As(err, &keyErr) || keyErr.File != path.Join(svc.root, "priv.asc") {
+		t.Fatal("Unexpected error: ", err)
+	}
+
+	// Several entities aren't mistaken for a bare key
+	thirdEntity, err := openpgp.NewEntity("Third", "", "", nil)
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	err = writeArmored(path.Join(svc.root, "priv.asc"), openpgp.PrivateKeyType, 0600, func(out io.Writer) error {
+		err := otherEntity.SerializePrivate(out, nil)
+		if err != nil {
+			return err
+		}
+		return thirdEntity.SerializePrivate(out, nil)
+	})
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	err = svc.LoadKeypair()
+	if !errors.As(err, &keyErr) || keyErr.Err.Error() != "expected exactly one private key" {
+		t.Fatal("Unexpected error: ", err)
+	}
+}
+
+func TestSigningEntityIdentity(t *testing.T) {
+	entity, err := openpgp.NewEntity("Other", "", "", nil)
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	// Two identities, neither flagged as primary, only the second one by name allows signing
+	signer := entity.Identities["Other"]
+	signer.SelfSignature.IsPrimaryId = nil
+	certifier := *signer
+	certifier.Name = "Another"
+	selfSignature := *signer.SelfSignature
+	selfSignature.FlagSign = false
+	certifier.SelfSignature = &selfSignature
+	entity.Identities[certifier.Name] = &certifier
+
+	for i := 0; i < 20; i++ {
+		_, err = signingEntity(entity, time.Now())
+		if err != ErrNoSigningKey {
+			t.Fatal("Expected ErrNoSigningKey, got ", err)
+		}
+	}
+
+	// The identity flagged as primary is used regardless of its name
+	isPrimary := true
+	signer.SelfSignature.IsPrimaryId = &isPrimary
+	for i := 0; i < 20; i++ {
+		_, err = signingEntity(entity, time.Now())
+		if err != nil {
+			t.Fatal("Unexpected error: ", err)
+		}
+	}
+}
+
+func TestKeyAlgorithms(t *testing.T) {
+	_, err := ParseKeyAlgorithm("ed25519")
+	if !errors.Is(err, ErrUnknownKeyAlgorithm) {
+		t.Fatal("Unexpected error: ", err)
+	}
+
+	expected := map[KeyAlgorithm]struct {
+		algo packet.PublicKeyAlgorithm
+		bits uint16
+	}{
+		KeyRSA3072:   {packet.PubKeyAlgoRSA, 3072},
+		KeyRSA4096:   {packet.PubKeyAlgoRSA, 4096},
+		KeyECDSAP256: {packet.PubKeyAlgoECDSA, 256},
+		KeyECDSAP384: {packet.PubKeyAlgoECDSA, 384},
+	}
+	for _, name := range []string{"rsa3072", "rsa4096", "p256", "P384"} {
+		algo, err := ParseKeyAlgorithm(name)
+		if err != nil {
+			t.Fatal("Unexpected error: ", err)
+		}
+		svc := initTestServer(t)
+		svc.SetKeyAlgorithm(algo)
+		// Encrypted keys have to work for every algorithm as well
+		svc.SetPassphrase(func() ([]byte, error) {
+			return []byte("secret"), nil
+		})
+		err = svc.GenerateKeypair()
+		if err != nil {
+			t.Fatal("Unexpected error: ", err)
+		}
+		err = svc.LoadKeypair()
+		if err != nil {
+			t.Fatal("Unexpected error: ", err)
+		}
+		// BitLength doesn't support ECDSA keys
+		var bits uint16
+		if ecdsaKey, ok := svc.entity.PrimaryKey.PublicKey.(*ecdsa.PublicKey); ok {
+			bits = uint16(ecdsaKey.Params().BitSize)
+		} else {
+			bits, err = svc.entity.PrimaryKey.BitLength()
+			if err != nil {
+				t.Fatal("Unexpected error: ", err)
+			}
+		}
+		if svc.entity.PrimaryKey.PubKeyAlgo != expected[algo].algo || bits != expected[algo].bits {
+			t.Fatal("Unexpected key for ", algo, ": ", svc.entity.PrimaryKey.PubKeyAlgo, " ", bits)
+		}
+		_, err = svc.UpdateMetadata()
+		if err != nil {
+			t.Fatal("Unexpected error: ", err)
+		}
+		err = checkSignature(svc, "pub.asc")
+		if err != nil {
+			t.Fatal("Unexpected error for ", algo, ": ", err)
+		}
+	}
+}
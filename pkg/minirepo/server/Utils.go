@@ -0,0 +1,343 @@
+/*
+ * Copyright 2018 The minirepo authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha1"
+	"errors"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/openpgp/packet"
+	"golang.org/x/crypto/openpgp/s2k"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// loadKeyFromFile loads an GPG ASCII-armored RSA key from 'file'. 'pubkey' decideds whether this is the public or the private part
+func loadKeyFromFile(file string, pubkey bool) (packet.Packet, error) {
+	pubkeyFD, err := os.Open(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, &KeyError{File: file, Err: ErrKeyNotFound}
+		}
+		return nil, &KeyError{File: file, Err: err}
+	}
+	defer pubkeyFD.Close()
+	res, err := armor.Decode(pubkeyFD)
+	if err != nil {
+		return nil, &KeyError{File: file, Err: err}
+	}
+
+	expectedType := openpgp.PrivateKeyType
+	if pubkey {
+		expectedType = openpgp.PublicKeyType
+	}
+	if res.Type != expectedType {
+		return nil, &KeyError{File: file, Err: errors.New("unexpected armor type " + res.Type)}
+	}
+	pkReader := packet.NewReader(res.Body)
+	pkPacket, err := pkReader.Next()
+	if err != nil {
+		return nil, &KeyError{File: file, Err: err}
+	}
+
+	if pubkey {
+		if _, ok := pkPacket.(*packet.PublicKey); !ok {
+			return nil, &KeyError{File: file, Err: errors.New("public key is not a public key")}
+		}
+	} else {
+		if _, ok := pkPacket.(*packet.PrivateKey); !ok {
+			return nil, &KeyError{File: file, Err: errors.New("private key is not a private key")}
+		}
+	}
+	return pkPacket, nil
+}
+
+// countPackets returns the number of packets in the GPG ASCII-armored file 'file'
+func countPackets(file string) (int, error) {
+	fd, err := os.Open(file)
+	if err != nil {
+		return 0, err
+	}
+	defer fd.Close()
+	block, err := armor.Decode(fd)
+	if err != nil {
+		return 0, err
+	}
+	packets := packet.NewReader(block.Body)
+	count := 0
+	for {
+		_, err = packets.Next()
+		if err == io.EOF {
+			return count, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		count++
+	}
+}
+
+// loadEntityFromFile loads a full GPG ASCII-armored entity including its private keys from 'file'
+func loadEntityFromFile(file string) (*openpgp.Entity, error) {
+	fd, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	entities, err := openpgp.ReadArmoredKeyRing(fd)
+	if err != nil {
+		return nil, err
+	}
+	if len(entities) != 1 || entities[0].PrivateKey == nil {
+		return nil, errors.New("expected exactly one private key")
+	}
+	return entities[0], nil
+}
+
+// signingEntity returns a copy of 'entity' whose private key is the one that should be used for signing at 'now', as
+// openpgp.DetachSign always signs using the private key of the entity. This is the newest valid signing subkey whose
+// private key is available, or the primary key if there is none and the primary key may sign.
+func signingEntity(entity *openpgp.Entity, now time.Time) (*openpgp.Entity, error) {
+	signer := *entity
+	var selected *openpgp.Subkey
+	for i, subkey := range entity.Subkeys {
+		if subkey.PrivateKey == nil || !subkey.Sig.FlagsValid || !subkey.Sig.FlagSign ||
+			!subkey.PublicKey.PubKeyAlgo.CanSign() || subkey.Sig.KeyExpired(now) {
+			continue
+		}
+		if selected == nil || subkey.PublicKey.CreationTime.After(selected.PublicKey.CreationTime) {
+			selected = &entity.Subkeys[i]
+		}
+	}
+	if selected != nil {
+		signer.PrivateKey = selected.PrivateKey
+		return &signer, nil
+	}
+
+	// Whether the primary key may sign is decided by the self-signature of the primary identity. If no identity is
+	// flagged as primary, the first one by name is used, as the order of the map is random.
+	var primary *openpgp.Identity
+	for _, ident := range entity.Identities {
+		isPrimary := ident.SelfSignature.IsPrimaryId != nil && *ident.SelfSignature.IsPrimaryId
+		wasPrimary := primary != nil && primary.SelfSignature.IsPrimaryId != nil && *primary.SelfSignature.IsPrimaryId
+		if primary == nil || (isPrimary && !wasPrimary) || (isPrimary == wasPrimary && ident.Name < primary.Name) {
+			primary = ident
+		}
+	}
+	if primary != nil && (!primary.SelfSignature.FlagsValid || primary.SelfSignature.FlagSign) &&
+		!primary.SelfSignature.KeyExpired(now) {
+		return &signer, nil
+	}
+	return nil, ErrNoSigningKey
+}
+
+// signingKeyId returns the ID of the key signatures by 'signer' are issued by
+func signingKeyId(signer *openpgp.Entity) uint64 {
+	return signer.PrivateKey.KeyId
+}
+
+// fakeEntity creates a fake opengpg.Entity from a public and private key that can be used to sign files
+func fakeEntity(pubkey *packet.PublicKey, privkey *packet.PrivateKey) *openpgp.Entity {
+	cfg := packet.Config{
+		DefaultCipher:          packet.CipherAES128,
+		DefaultHash:            crypto.SHA384,
+		DefaultCompressionAlgo: packet.CompressionNone,
+	}
+
+	entity := openpgp.Entity{
+		PrimaryKey: pubkey,
+		PrivateKey: privkey,
+		Identities: make(map[string]*openpgp.Identity),
+	}
+
+	// Create fake identity
+	// We need an identity, not because it is used or important in any way but because Sign(...) will use the
+	// same hash function (hardcoded) or fall back to RIPEMD...
+	trueVal := true
+	hid, _ := s2k.HashToHashId(crypto.SHA256)
+	entity.Identities[""] = &openpgp.Identity{
+		Name:   "",
+		UserId: packet.NewUserId("", "", ""),
+		SelfSignature: &packet.Signature{
+			CreationTime:  time.Now(),
+			SigType:       packet.SigTypePositiveCert,
+			PubKeyAlgo:    pubkey.PubKeyAlgo,
+			Hash:          cfg.Hash(),
+			IsPrimaryId:   &trueVal,
+			FlagSign:      true,
+			FlagsValid:    true,
+			FlagCertify:   true,
+			IssuerKeyId:   &pubkey.KeyId,
+			PreferredHash: []uint8{hid},
+		},
+	}
+
+	return &entity
+}
+
+// serializePrivateEncrypted writes 'entity' including its private keys to 'out' like openpgp.Entity.SerializePrivate
+// does, but encrypts the private keys using 'passphrase'
+func serializePrivateEncrypted(out io.Writer, entity *openpgp.Entity, passphrase []byte, cfg *packet.Config) error {
+	// SerializePrivate creates the self-signatures, which we can then write out as they are
+	err := entity.SerializePrivate(ioutil.Discard, cfg)
+	if err != nil {
+		return err
+	}
+
+	err = serializeEncryptedKey(out, entity.PrivateKey, passphrase)
+	if err != nil {
+		return err
+	}
+	for _, ident := range entity.Identities {
+		err = ident.UserId.Serialize(out)
+		if err != nil {
+			return err
+		}
+		err = ident.SelfSignature.Serialize(out)
+		if err != nil {
+			return err
+		}
+	}
+	for _, subkey := range entity.Subkeys {
+		err = serializeEncryptedKey(out, subkey.PrivateKey, passphrase)
+		if err != nil {
+			return err
+		}
+		err = subkey.Sig.Serialize(out)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// serializeEncryptedKey writes the private key 'privkey' to 'out', encrypted with AES-256 using a key derived from
+// 'passphrase'. The packet can be decrypted using packet.PrivateKey.Decrypt.
+func serializeEncryptedKey(out io.Writer, privkey *packet.PrivateKey, passphrase []byte) error {
+	// The unencrypted packet contains the public key, a zero byte (not encrypted), the key material and a checksum
+	plainPacket := &bytes.Buffer{}
+	err := privkey.Serialize(plainPacket)
+	if err != nil {
+		return err
+	}
+	pubPacket := &bytes.Buffer{}
+	err = privkey.PublicKey.Serialize(pubPacket)
+	if err != nil {
+		return err
+	}
+	plainBody := packetBody(plainPacket.Bytes())
+	pubBody := packetBody(pubPacket.Bytes())
+	keyMaterial := plainBody[len(pubBody)+1 : len(plainBody)-2]
+
+	body := &bytes.Buffer{}
+	body.Write(pubBody)
+	// S2K usage 254: encrypted, protected by a SHA-1 hash
+	body.Write([]byte{254, byte(packet.CipherAES256)})
+	key := make([]byte, packet.CipherAES256.KeySize())
+	err = s2k.Serialize(body, key, rand.Reader, passphrase, &s2k.Config{Hash: crypto.SHA256})
+	if err != nil {
+		return err
+	}
+	iv := make([]byte, aes.BlockSize)
+	_, err = io.ReadFull(rand.Reader, iv)
+	if err != nil {
+		return err
+	}
+	body.Write(iv)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	checksum := sha1.Sum(keyMaterial)
+	encrypted := append(append([]byte{}, keyMaterial...), checksum[:]...)
+	cipher.NewCFBEncrypter(block, iv).XORKeyStream(encrypted, encrypted)
+	body.Write(encrypted)
+
+	return writePacket(out, 5, body.Bytes())
+}
+
+// packetBody strips the (new format) header from the serialized packet 'data'
+func packetBody(data []byte) []byte {
+	switch {
+	case data[1] < 192:
+		return data[2:]
+	case data[1] < 224:
+		return data[3:]
+	}
+	return data[6:]
+}
+
+// writePacket writes a packet of type 'tag' containing 'body' to 'out', using a new format header
+func writePacket(out io.Writer, tag byte, body []byte) error {
+	header := []byte{0xc0 | tag}
+	length := len(body)
+	switch {
+	case length < 192:
+		header = append(header, byte(length))
+	case length < 8384:
+		length -= 192
+		header = append(header, byte(192+length>>8), byte(length))
+	default:
+		header = append(header, 255, byte(length>>24), byte(length>>16), byte(length>>8), byte(length))
+	}
+	_, err := out.Write(header)
+	if err != nil {
+		return err
+	}
+	_, err = out.Write(body)
+	return err
+}
+
+// writeFileAtomic replaces 'file' with 'data' by writing a temporary file first and renaming it, so the file is never
+// left partially written
+func writeFileAtomic(file string, data []byte, mode os.FileMode) error {
+	return writeFilesAtomic([]string{file}, [][]byte{data}, mode)
+}
+
+// writeFilesAtomic is like writeFileAtomic, but replaces each of 'files' with the corresponding entry of 'data'. No
+// file is replaced before all of them were written. They are renamed in order, so readers might still see a mix of
+// old and new files for a moment.
+func writeFilesAtomic(files []string, data [][]byte, mode os.FileMode) error {
+	for i, file := range files {
+		tempFile := file + ".tmp"
+		err := ioutil.WriteFile(tempFile, data[i], mode)
+		if err != nil {
+			for _, written := range files[:i+1] {
+				os.Remove(written + ".tmp")
+			}
+			return &FileError{Path: tempFile, Err: err}
+		}
+	}
+	for i, file := range files {
+		err := os.Rename(file+".tmp", file)
+		if err != nil {
+			for _, pending := range files[i:] {
+				os.Remove(pending + ".tmp")
+			}
+			return &FileError{Path: file, Err: err}
+		}
+	}
+	return nil
+}
@@ -19,14 +19,21 @@ package types
 
 import "time"
 
+// ReservedDir is the directory in the root of a client's cache that contains internal files such as locks and partial
+// downloads. Repositories can't contain a directory of this name.
+const ReservedDir = ".minirepo"
+
 // DirEntry contains a directory entry. This struct represents either
-//  - a single file (Name and Hash set) or
+//  - a single file (Name, Hash and Size set) or
 //  - a child directory (Name and Children set)
 type DirEntry struct {
 	// Name of this entry
 	Name string
 	// If this is a file, contains the SHA-256 hash of it in Hex encoding
 	Hash string `yaml:"hash,omitempty"`
+	// If this is a file, contains its size in bytes. Metadata created by older versions doesn't contain this field, so
+	// it is nil for their files.
+	Size *int64 `yaml:"size,omitempty"`
 	// If this is a directory, contains a list of all children
 	Children []DirEntry `yaml:"children,omitempty"`
 }
@@ -39,4 +46,18 @@ type RepoInfo struct {
 	Name string
 	// Timestamp of last update
 	Timestamp time.Time
+	// Point in time after which clients should consider this metadata stale, if set
+	Expires *time.Time `yaml:"expires,omitempty"`
+	// Signing keys clients should trust in addition to the keys they know, used while the repository key is rotated
+	NextKeys []AnnouncedKey `yaml:"nextkeys,omitempty"`
+}
+
+// AnnouncedKey is a signing key announced inside the metadata
+type AnnouncedKey struct {
+	// Fingerprint of the primary key in upper case Hex encoding
+	Fingerprint string
+	// Full ASCII-armored public key
+	Key string
+	// Fingerprint of the key replaced by this key in upper case Hex encoding
+	Replaces string
 }